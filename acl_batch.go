@@ -0,0 +1,241 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// ACLBatchConfig configures sending several ACL checks to a batch endpoint in one request
+type ACLBatchConfig struct {
+	Host    string        // batch endpoint, batching is disabled when empty
+	Hosts   []Endpoint    // additional batch endpoints used alongside Host
+	Window  time.Duration // how long ACL checks are collected before being sent together, zero only batches the filters of a SUBSCRIBE
+	MaxSize int           // most checks in a single request, defaults to 100
+}
+
+// ACLBatchPOST is sent to the batch endpoint. The endpoint answers with an ACLBatchResponse holding
+// one result per check, in the same order
+type ACLBatchPOST struct {
+	Checks []ACLCheckPOST `json:"checks"`
+}
+
+func (p ACLBatchPOST) fields() map[string]any {
+	return map[string]any{
+		"checks": p.Checks,
+	}
+}
+
+// ACLBatchResponse is the body returned by the batch endpoint
+type ACLBatchResponse struct {
+	Results []AuthResponse `json:"results"`
+}
+
+// aclBatcher collects ACL checks for up to a window and sends them as one request
+type aclBatcher struct {
+	hook    *HTTPAuthHook
+	window  time.Duration
+	maxSize int
+	mu      sync.Mutex
+	pending []*batchItem
+	timer   *time.Timer
+}
+
+type batchItem struct {
+	check  ACLCheckPOST
+	result chan batchResult
+}
+
+type batchResult struct {
+	resp AuthResponse
+	err  error
+}
+
+type prefetchKey struct {
+	topic  string
+	access ACLAccess
+}
+
+// check queues a check and waits for the result of the batch it is sent with
+func (b *aclBatcher) check(ctx context.Context, check ACLCheckPOST) (AuthResponse, error) {
+	item := &batchItem{
+		check:  check,
+		result: make(chan batchResult, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	switch {
+	case len(b.pending) >= b.maxSize:
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		go b.send(b.take())
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case r := <-item.result:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return AuthResponse{}, ctx.Err()
+	}
+}
+
+func (b *aclBatcher) flush() {
+	b.mu.Lock()
+	b.timer = nil
+	items := b.take()
+	b.mu.Unlock()
+
+	b.send(items)
+}
+
+// take must be called with the lock held
+func (b *aclBatcher) take() []*batchItem {
+	items := b.pending
+	b.pending = nil
+	return items
+}
+
+func (b *aclBatcher) send(items []*batchItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	checks := make([]ACLCheckPOST, len(items))
+	for i, item := range items {
+		checks[i] = item.check
+	}
+
+	ctx, cancel := withTimeout(b.hook.ctx, b.hook.timeouts.ACL)
+	defer cancel()
+
+	results, err := b.hook.sendACLBatch(ctx, checks)
+	for i, item := range items {
+		if err != nil {
+			item.result <- batchResult{err: err}
+			continue
+		}
+		item.result <- batchResult{resp: results[i]}
+	}
+}
+
+// sendACLBatch sends checks to the batch endpoint and returns their results in order
+func (h *HTTPAuthHook) sendACLBatch(ctx context.Context, checks []ACLCheckPOST) ([]AuthResponse, error) {
+	resp, err := h.makeRequest(ctx, h.batchrequest, h.batchhosts, ACLBatchPOST{Checks: checks}, RequestTemplateData{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, maxResponseBodySize)
+	defer io.Copy(io.Discard, body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("acl batch request returned status %d", resp.StatusCode)
+	}
+
+	var batchResp ACLBatchResponse
+	if err := json.NewDecoder(body).Decode(&batchResp); err != nil {
+		return nil, fmt.Errorf("failed to decode acl batch response: %w", err)
+	}
+	if len(batchResp.Results) != len(checks) {
+		return nil, errors.New("acl batch response does not have a result for every check")
+	}
+
+	return batchResp.Results, nil
+}
+
+// OnSubscribe checks all filters of a SUBSCRIBE with a single batch request before mochi checks each
+// filter on its own, so the individual checks are answered from the results
+func (h *HTTPAuthHook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	// results left over from an earlier SUBSCRIBE are never reused
+	h.batchLock.Lock()
+	delete(h.prefetched, cl)
+	h.batchLock.Unlock()
+
+	if len(pk.Filters) < 2 || h.checkIfClientBlocked(cl) || h.checkSuperuser(cl) {
+		return pk
+	}
+
+	var checks []ACLCheckPOST
+	for _, sub := range pk.Filters {
+		if h.checkSessionACL(cl, sub.Filter) {
+			continue
+		}
+		key := aclDecisionKey(cl.ID, string(cl.Properties.Username), sub.Filter, h.subscribeAccess)
+		if _, ok := h.cache.get(key); ok {
+			continue
+		}
+		checks = append(checks, ACLCheckPOST{
+			ClientID: cl.ID,
+			Username: string(cl.Properties.Username),
+			Topic:    sub.Filter,
+			ACC:      h.subscribeAccess,
+		})
+	}
+	if len(checks) < 2 {
+		return pk
+	}
+
+	ctx, cancel := withTimeout(h.clientContext(cl), h.timeouts.ACL)
+	defer cancel()
+
+	results, err := h.sendACLBatch(ctx, checks)
+	if err != nil {
+		// the filters are checked one by one instead
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("acl batch request failed")
+		return pk
+	}
+
+	prefetched := make(map[prefetchKey]bool, len(checks))
+	for i, check := range checks {
+		allowed := results[i].Result == "allow"
+		prefetched[prefetchKey{topic: check.Topic, access: check.ACC}] = allowed
+
+		key := aclDecisionKey(cl.ID, check.Username, check.Topic, check.ACC)
+		h.cache.setWithTTL(key, allowed, ttlHint(results[i]))
+	}
+
+	h.batchLock.Lock()
+	h.prefetched[cl] = prefetched
+	h.batchLock.Unlock()
+
+	return pk
+}
+
+// takePrefetched returns the result of a check answered by the batch request of a SUBSCRIBE. Each result
+// is only used once
+func (h *HTTPAuthHook) takePrefetched(cl *mqtt.Client, topic string, access ACLAccess) (bool, bool) {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	prefetched, ok := h.prefetched[cl]
+	if !ok {
+		return false, false
+	}
+
+	key := prefetchKey{topic: topic, access: access}
+	allowed, ok := prefetched[key]
+	if !ok {
+		return false, false
+	}
+
+	delete(prefetched, key)
+	if len(prefetched) == 0 {
+		delete(h.prefetched, cl)
+	}
+
+	return allowed, true
+}
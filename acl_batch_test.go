@@ -0,0 +1,146 @@
+package mochicloudhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// respondToBatch answers a batch request by allowing the topics in allow
+func respondToBatch(t *testing.T, allow ...string) func(r *http.Request) (*http.Response, error) {
+	return func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, "batchhost.com", r.URL.Host)
+
+		var batch ACLBatchPOST
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+
+		var resp ACLBatchResponse
+		for _, check := range batch.Checks {
+			result := "deny"
+			if containsString(allow, check.Topic) {
+				result = "allow"
+			}
+			resp.Results = append(resp.Results, AuthResponse{Result: result})
+		}
+
+		b, err := json.Marshal(resp)
+		require.NoError(t, err)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(b)))}, nil
+	}
+}
+
+func subscribePacket(filters ...string) packets.Packet {
+	pk := packets.Packet{}
+	for _, filter := range filters {
+		pk.Filters = append(pk.Filters, packets.Subscription{Filter: filter})
+	}
+	return pk
+}
+
+func TestACLBatchSubscribe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ACLBatch:                 ACLBatchConfig{Host: "http://batchhost.com"},
+	}))
+	require.True(t, authHook.Provides(mqtt.OnSubscribe))
+
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	// one request decides every filter of the SUBSCRIBE
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(respondToBatch(t, "a", "c")).Times(1)
+	authHook.OnSubscribe(cl, subscribePacket("a", "b", "c"))
+
+	require.True(t, authHook.OnACLCheck(cl, "a", false))
+	require.False(t, authHook.OnACLCheck(cl, "b", false))
+	require.True(t, authHook.OnACLCheck(cl, "c", false))
+
+	// a result is only used once, later checks go to the ACL endpoint
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, "aclhost.com", r.URL.Host)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}).Times(1)
+	require.True(t, authHook.OnACLCheck(cl, "b", false))
+}
+
+func TestACLBatchSubscribeFallback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ACLBatch:                 ACLBatchConfig{Host: "http://batchhost.com"},
+	}))
+
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	// a result missing from the batch response fails the batch, so each filter is checked on its own
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"results": [{"result": "allow"}]}`)),
+	}, nil).Times(1)
+	authHook.OnSubscribe(cl, subscribePacket("a", "b"))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(2)
+	require.True(t, authHook.OnACLCheck(cl, "a", false))
+	require.True(t, authHook.OnACLCheck(cl, "b", false))
+}
+
+func TestACLBatchWindow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ACLBatch: ACLBatchConfig{
+			Host:    "http://batchhost.com",
+			Window:  50 * time.Millisecond,
+			MaxSize: 3,
+		},
+	}))
+
+	// checks from different clients within the window share a request, a full batch is sent at once
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(respondToBatch(t, "allowed")).Times(2)
+
+	topics := []string{"allowed", "denied", "allowed", "allowed"}
+	results := make([]bool, len(topics))
+
+	var wg sync.WaitGroup
+	for i, topic := range topics {
+		wg.Add(1)
+		go func(i int, topic string) {
+			defer wg.Done()
+			results[i] = authHook.OnACLCheck(&mqtt.Client{ID: topic}, topic, true)
+		}(i, topic)
+	}
+	wg.Wait()
+
+	require.Equal(t, []bool{true, false, true, true}, results)
+}
@@ -0,0 +1,141 @@
+package mochicloudhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ErrBlockingDisabled is returned by the block admin methods when no Timeout was configured
+var ErrBlockingDisabled = errors.New("client blocking is not configured")
+
+// BlockedClient is a block as listed by HTTPAuthHook.Blocks. Key is a block key such as "clientid:abc",
+// "username:user", "ip:10.0.0.1" or a combination like "username:user|ip:10.0.0.1". A % or | in a client
+// ID or username is percent-encoded as %25 or %7C
+type BlockedClient struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+// Blocks returns every block that has not yet expired, sorted by key
+func (h *HTTPAuthHook) Blocks() ([]BlockedClient, error) {
+	if h.blocks == nil {
+		return nil, ErrBlockingDisabled
+	}
+
+	blocks, err := h.blocks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BlockedClient, 0, len(blocks))
+	for key, until := range blocks {
+		list = append(list, BlockedClient{Key: key, Until: until})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+
+	return list, nil
+}
+
+// AddBlock blocks key until the given time, regardless of the failure threshold
+func (h *HTTPAuthHook) AddBlock(key string, until time.Time) error {
+	if h.blocks == nil {
+		return ErrBlockingDisabled
+	}
+	if key == "" {
+		return errors.New("empty block key")
+	}
+
+	return h.blocks.Block(key, until)
+}
+
+// RemoveBlock lifts any block on key and forgets its rejections, so the next block of key starts again
+// from the first escalation duration. Cached connect denials are dropped so the client is asked about again
+func (h *HTTPAuthHook) RemoveBlock(key string) error {
+	if h.blocks == nil {
+		return ErrBlockingDisabled
+	}
+
+	if err := h.blocks.Unblock(key); err != nil {
+		return err
+	}
+	h.cache.invalidateDeniedConnects()
+
+	if err := h.blocks.ResetCount("fail:" + key); err != nil {
+		return err
+	}
+
+	return h.blocks.ResetCount("offense:" + key)
+}
+
+// blockAdminHandler serves the blocks of an HTTPAuthHook
+type blockAdminHandler struct {
+	hook *HTTPAuthHook
+}
+
+// NewBlockAdminHandler returns an http.Handler to inspect and manage the blocks of the hook as JSON.
+// GET lists the blocks, POST adds the block in the body, e.g. {"key": "clientid:abc", "until": "2030-01-01T00:00:00Z"},
+// and DELETE with a key query parameter removes a block. The handler does no authentication of its own
+// and should only be exposed to trusted callers
+func NewBlockAdminHandler(h *HTTPAuthHook) http.Handler {
+	return &blockAdminHandler{
+		hook: h,
+	}
+}
+
+func (a *blockAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		blocks, err := a.hook.Blocks()
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blocks)
+
+	case http.MethodPost:
+		var block BlockedClient
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxResponseBodySize)).Decode(&block); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if block.Key == "" || !time.Now().Before(block.Until) {
+			http.Error(w, "a key and a future until are required", http.StatusBadRequest)
+			return
+		}
+		if err := a.hook.AddBlock(block.Key, block.Until); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "a key is required", http.StatusBadRequest)
+			return
+		}
+		if err := a.hook.RemoveBlock(key); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBlockingDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,179 @@
+package mochicloudhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockAdmin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+	}))
+	defer authHook.Stop()
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Body:       http.NoBody,
+	}, nil)
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	blocks, err := authHook.Blocks()
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.Equal(t, "clientid:"+defaultClientID, blocks[0].Key)
+
+	require.NoError(t, authHook.RemoveBlock(blocks[0].Key))
+	require.False(t, authHook.checkIfClientBlocked(cl))
+
+	require.NoError(t, authHook.AddBlock("clientid:"+defaultClientID, time.Now().Add(time.Minute)))
+	require.True(t, authHook.checkIfClientBlocked(cl))
+}
+
+func TestBlockAdminRemoveBlockClearsCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+		Cache: CacheConfig{
+			Size:        10,
+			PositiveTTL: time.Minute,
+			NegativeTTL: time.Minute,
+		},
+	}))
+	defer authHook.Stop()
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody}, nil)
+	require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	// once the block is lifted the client is asked about again instead of denied from the cache
+	require.NoError(t, authHook.RemoveBlock("clientid:"+defaultClientID))
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil)
+	require.True(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestJSONDenialBlocksClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ResponseMode:             ResponseModeJSON,
+		Timeout: TimeoutConfig{
+			TimeoutDuration:  time.Minute,
+			FailureThreshold: 2,
+		},
+	}))
+	defer authHook.Stop()
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"result":"deny"}`))}, nil
+	}).Times(2)
+
+	// a denying body counts towards the failure threshold like a 401
+	require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.False(t, authHook.checkIfClientBlocked(cl))
+	require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, authHook.checkIfClientBlocked(cl))
+}
+
+func TestBlockAdminDisabled(t *testing.T) {
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+	}))
+
+	_, err := authHook.Blocks()
+	require.ErrorIs(t, err, ErrBlockingDisabled)
+
+	rec := httptest.NewRecorder()
+	NewBlockAdminHandler(authHook).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestBlockAdminHandler(t *testing.T) {
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+	}))
+	defer authHook.Stop()
+
+	handler := NewBlockAdminHandler(authHook)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rec := serve(http.MethodPost, "/", `{"key": "ip:10.0.0.1", "until": "`+until.Format(time.RFC3339)+`"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(http.MethodGet, "/", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var blocks []BlockedClient
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&blocks))
+	require.Len(t, blocks, 1)
+	require.Equal(t, "ip:10.0.0.1", blocks[0].Key)
+	require.True(t, until.Equal(blocks[0].Until))
+
+	rec = serve(http.MethodDelete, "/?key=ip:10.0.0.1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(http.MethodGet, "/", "")
+	require.JSONEq(t, "[]", rec.Body.String())
+
+	// malformed and past blocks are rejected
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/", "{").Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/", `{"key": "ip:10.0.0.1", "until": "2000-01-01T00:00:00Z"}`).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodDelete, "/", "").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodPut, "/", "").Code)
+}
@@ -0,0 +1,210 @@
+package mochicloudhooks
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+)
+
+// BlockStore stores blocked clients and when they may try again. Sharing a store between brokers,
+// e.g. with RedisBlockStore, blocks a client on every broker at once. Implementations must be safe
+// for concurrent use
+type BlockStore interface {
+	// BlockedUntil returns when the block on key ends and whether key is blocked at all
+	BlockedUntil(key string) (time.Time, bool, error)
+	// Block blocks key until the given time
+	Block(key string, until time.Time) error
+	// Unblock removes any block on key
+	Unblock(key string) error
+	// Increment adds one to the counter at key and returns the new count. The counter is forgotten
+	// once ttl has passed without an increment
+	Increment(key string, ttl time.Duration) (int64, error)
+	// ResetCount forgets the counter at key
+	ResetCount(key string) error
+	// List returns every block that has not yet expired
+	List() (map[string]time.Time, error)
+}
+
+// BlockKey selects what a block applies to. Flags can be combined so a block only applies to clients
+// matching all of them, e.g. BlockByUsername|BlockByRemoteIP blocks a username from a single address
+type BlockKey int
+
+const (
+	// BlockByClientID blocks the client ID
+	BlockByClientID BlockKey = 1 << iota
+	// BlockByUsername blocks the username
+	BlockByUsername
+	// BlockByRemoteIP blocks the remote address of the client
+	BlockByRemoteIP
+)
+
+// blockKeyEscaper escapes the separator in the values of a block key, so a value can not pose as
+// another part of a combined key
+var blockKeyEscaper = strings.NewReplacer("%", "%25", "|", "%7C")
+
+// key returns the store key of the block for the client, empty if the client has no value for a flag.
+// Any % or | in the values is percent-encoded
+func (bk BlockKey) key(cl *mqtt.Client) string {
+	var parts []string
+
+	if bk&BlockByClientID != 0 {
+		if cl.ID == "" {
+			return ""
+		}
+		parts = append(parts, "clientid:"+blockKeyEscaper.Replace(cl.ID))
+	}
+	if bk&BlockByUsername != 0 {
+		if len(cl.Properties.Username) == 0 {
+			return ""
+		}
+		parts = append(parts, "username:"+blockKeyEscaper.Replace(string(cl.Properties.Username)))
+	}
+	if bk&BlockByRemoteIP != 0 {
+		if cl.Net.Remote == "" {
+			return ""
+		}
+		parts = append(parts, "ip:"+remoteIP(cl.Net.Remote))
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// MemoryBlockStore is the default in-process BlockStore. Expired blocks are removed by a background
+// sweeper so clients that never come back do not accumulate
+type MemoryBlockStore struct {
+	mu       sync.Mutex
+	blocks   map[string]time.Time
+	counters map[string]memoryCounter
+	done     chan struct{}
+	once     sync.Once
+}
+
+type memoryCounter struct {
+	count   int64
+	expires time.Time
+}
+
+// NewMemoryBlockStore returns a MemoryBlockStore sweeping expired blocks every sweepInterval.
+// A sweepInterval of zero or less disables the sweeper
+func NewMemoryBlockStore(sweepInterval time.Duration) *MemoryBlockStore {
+	s := &MemoryBlockStore{
+		blocks:   make(map[string]time.Time),
+		counters: make(map[string]memoryCounter),
+		done:     make(chan struct{}),
+	}
+
+	if sweepInterval > 0 {
+		go s.sweep(sweepInterval)
+	}
+
+	return s
+}
+
+// BlockedUntil returns when the block on key ends and whether key is blocked at all
+func (s *MemoryBlockStore) BlockedUntil(key string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.blocks[key]
+	return until, ok, nil
+}
+
+// Block blocks key until the given time
+func (s *MemoryBlockStore) Block(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocks[key] = until
+	return nil
+}
+
+// Unblock removes any block on key
+func (s *MemoryBlockStore) Unblock(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blocks, key)
+	return nil
+}
+
+// List returns every block that has not yet expired
+func (s *MemoryBlockStore) List() (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	blocks := make(map[string]time.Time, len(s.blocks))
+	for key, until := range s.blocks {
+		if now.Before(until) {
+			blocks[key] = until
+		}
+	}
+
+	return blocks, nil
+}
+
+// Increment adds one to the counter at key and returns the new count
+func (s *MemoryBlockStore) Increment(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	c := s.counters[key]
+	if !now.Before(c.expires) {
+		c.count = 0
+	}
+	c.count++
+	c.expires = now.Add(ttl)
+	s.counters[key] = c
+
+	return c.count, nil
+}
+
+// ResetCount forgets the counter at key
+func (s *MemoryBlockStore) ResetCount(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.counters, key)
+	return nil
+}
+
+// Close stops the sweeper
+func (s *MemoryBlockStore) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *MemoryBlockStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.removeExpired(now)
+		}
+	}
+}
+
+func (s *MemoryBlockStore) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, until := range s.blocks {
+		if !now.Before(until) {
+			delete(s.blocks, key)
+		}
+	}
+	for key, c := range s.counters {
+		if !now.Before(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package mochicloudhooks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBlockStore(t *testing.T) {
+	store := NewMemoryBlockStore(0)
+	defer store.Close()
+
+	_, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	until := time.Now().Add(time.Minute)
+	require.NoError(t, store.Block("client", until))
+
+	got, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, until, got)
+
+	require.NoError(t, store.Unblock("client"))
+	_, ok, err = store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMemoryBlockStoreList(t *testing.T) {
+	store := NewMemoryBlockStore(0)
+	defer store.Close()
+
+	until := time.Now().Add(time.Minute)
+	require.NoError(t, store.Block("blocked", until))
+	require.NoError(t, store.Block("expired", time.Now().Add(-time.Second)))
+
+	blocks, err := store.List()
+	require.NoError(t, err)
+	require.Equal(t, map[string]time.Time{"blocked": until}, blocks)
+}
+
+func TestMemoryBlockStoreIncrement(t *testing.T) {
+	store := NewMemoryBlockStore(0)
+	defer store.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := store.Increment("key", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, i, n)
+	}
+
+	require.NoError(t, store.ResetCount("key"))
+	n, err := store.Increment("key", time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	time.Sleep(2 * time.Millisecond)
+	n, err = store.Increment("key", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+}
+
+func TestBlockKey(t *testing.T) {
+	cl := &mqtt.Client{ID: "client"}
+	cl.Properties.Username = []byte("user")
+	cl.Net.Remote = "10.0.0.1:5000"
+
+	require.Equal(t, "clientid:client", BlockByClientID.key(cl))
+	require.Equal(t, "username:user", BlockByUsername.key(cl))
+	require.Equal(t, "ip:10.0.0.1", BlockByRemoteIP.key(cl))
+	require.Equal(t, "username:user|ip:10.0.0.1", (BlockByUsername | BlockByRemoteIP).key(cl))
+
+	// a combination is skipped when the client lacks one of its values
+	require.Equal(t, "", (BlockByClientID | BlockByUsername).key(&mqtt.Client{ID: "client"}))
+
+	// values can not pose as another part of a combined key
+	spoofed := &mqtt.Client{ID: "client"}
+	spoofed.Properties.Username = []byte("user|ip:10.0.0.1")
+	require.Equal(t, "username:user%7Cip:10.0.0.1", BlockByUsername.key(spoofed))
+	require.NotEqual(t, (BlockByUsername | BlockByRemoteIP).key(cl), BlockByUsername.key(spoofed))
+
+	encoded := &mqtt.Client{ID: "client%7C"}
+	require.Equal(t, "clientid:client%257C", BlockByClientID.key(encoded))
+}
+
+func TestMemoryBlockStoreSweep(t *testing.T) {
+	store := NewMemoryBlockStore(5 * time.Millisecond)
+	defer store.Close()
+
+	require.NoError(t, store.Block("expired", time.Now().Add(-time.Second)))
+	require.NoError(t, store.Block("blocked", time.Now().Add(time.Minute)))
+
+	require.Eventually(t, func() bool {
+		_, ok, _ := store.BlockedUntil("expired")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+
+	_, ok, err := store.BlockedUntil("blocked")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// closing twice is safe
+	require.NoError(t, store.Close())
+}
@@ -0,0 +1,176 @@
+package mochicloudhooks
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig configures the circuit breakers guarding the auth endpoints, one per endpoint type.
+// A FailureThreshold of zero disables the breaker
+type CircuitBreakerConfig struct {
+	FailureThreshold    int           // consecutive failures before the breaker opens
+	OpenTimeout         time.Duration // how long the breaker stays open before probing the endpoint again
+	HalfOpenMaxRequests int           // concurrent probes allowed while half-open, defaults to 1
+	SuccessThreshold    int           // successful probes required to close the breaker, defaults to 1
+}
+
+// FailurePolicy decides what the hook returns while the circuit breaker is open
+type FailurePolicy int
+
+const (
+	// FailClosed denies every check while the breaker is open
+	FailClosed FailurePolicy = iota
+	// FailOpen allows every check while the breaker is open
+	FailOpen
+	// FailCached allows only checks that were previously allowed and are still in the decision cache
+	FailCached
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type circuitBreaker struct {
+	mu            sync.Mutex
+	config        CircuitBreakerConfig
+	state         circuitState
+	failures      int
+	successes     int
+	probes        int
+	openedAt      time.Time
+	onStateChange func(from, to circuitState)
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig, onStateChange func(from, to circuitState)) *circuitBreaker {
+	if config.FailureThreshold <= 0 {
+		return nil
+	}
+
+	if config.HalfOpenMaxRequests <= 0 {
+		config.HalfOpenMaxRequests = 1
+	}
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = 1
+	}
+
+	return &circuitBreaker{
+		config:        config,
+		onStateChange: onStateChange,
+	}
+}
+
+// allow reports whether a request may be sent to the endpoint
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.config.OpenTimeout {
+			return false
+		}
+		cb.setState(circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if cb.probes >= cb.config.HalfOpenMaxRequests {
+			return false
+		}
+		cb.probes++
+	}
+
+	return true
+}
+
+// record reports the outcome of a request that was allowed by the breaker
+func (cb *circuitBreaker) record(success bool) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitClosed:
+		if success {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.config.FailureThreshold {
+			cb.setState(circuitOpen)
+		}
+	case circuitHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		if !success {
+			cb.setState(circuitOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.config.SuccessThreshold {
+			cb.setState(circuitClosed)
+		}
+	}
+}
+
+// release gives back a request allowed by the breaker without recording an outcome
+func (cb *circuitBreaker) release() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// setState must be called with the lock held
+func (cb *circuitBreaker) setState(state circuitState) {
+	from := cb.state
+	cb.state = state
+	cb.failures = 0
+	cb.successes = 0
+	cb.probes = 0
+	if state == circuitOpen {
+		cb.openedAt = time.Now()
+	}
+
+	if cb.onStateChange != nil && from != state {
+		cb.onStateChange(from, state)
+	}
+}
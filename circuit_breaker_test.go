@@ -0,0 +1,261 @@
+package mochicloudhooks
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{}, nil)
+	require.Nil(t, cb)
+	require.True(t, cb.allow())
+	cb.record(false)
+	require.True(t, cb.allow())
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var transitions []string
+	cb := newCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      10 * time.Millisecond,
+	}, func(from, to circuitState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+
+	// a success resets the consecutive failure count
+	require.True(t, cb.allow())
+	cb.record(false)
+	require.True(t, cb.allow())
+	cb.record(true)
+	require.True(t, cb.allow())
+	cb.record(false)
+	require.Equal(t, circuitClosed, cb.currentState())
+
+	require.True(t, cb.allow())
+	cb.record(false)
+	require.Equal(t, circuitOpen, cb.currentState())
+	require.False(t, cb.allow())
+
+	// after the open timeout a single probe is let through
+	time.Sleep(15 * time.Millisecond)
+	require.True(t, cb.allow())
+	require.Equal(t, circuitHalfOpen, cb.currentState())
+	require.False(t, cb.allow())
+
+	// a failed probe reopens the breaker
+	cb.record(false)
+	require.Equal(t, circuitOpen, cb.currentState())
+
+	time.Sleep(15 * time.Millisecond)
+	require.True(t, cb.allow())
+	cb.record(true)
+	require.Equal(t, circuitClosed, cb.currentState())
+
+	require.Equal(t, []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}, transitions)
+}
+
+func TestHTTPAuthHookFailurePolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name       string
+		policy     FailurePolicy
+		topic      string
+		expectPass bool
+	}{
+		{
+			name:       "Success - Fail closed denies",
+			policy:     FailClosed,
+			topic:      "/topic",
+			expectPass: false,
+		},
+		{
+			name:       "Success - Fail open allows",
+			policy:     FailOpen,
+			topic:      "/other",
+			expectPass: true,
+		},
+		{
+			name:       "Success - Fail cached allows cached decision",
+			policy:     FailCached,
+			topic:      "/topic",
+			expectPass: true,
+		},
+		{
+			name:       "Success - Fail cached denies uncached decision",
+			policy:     FailCached,
+			topic:      "/other",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHost:                  "http://aclhost.com",
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+				Cache: CacheConfig{
+					Size:        10,
+					PositiveTTL: time.Millisecond,
+				},
+				CircuitBreaker: CircuitBreakerConfig{
+					FailureThreshold: 1,
+					OpenTimeout:      time.Minute,
+				},
+				FailurePolicy: tt.policy,
+			}))
+
+			client := &mqtt.Client{ID: defaultClientID}
+
+			mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+			require.True(t, authHook.OnACLCheck(client, "/topic", false))
+
+			// let the cached decision expire, then trip the breaker
+			time.Sleep(5 * time.Millisecond)
+			mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap")).Times(1)
+			require.False(t, authHook.OnACLCheck(client, "/trip", false))
+
+			// the endpoint is no longer called while the breaker is open
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(client, tt.topic, false))
+		})
+	}
+}
+
+func TestHTTPAuthHookFailCachedReconnect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ResponseMode:             ResponseModeJSON,
+		Cache: CacheConfig{
+			Size:        10,
+			PositiveTTL: time.Millisecond,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 1,
+			OpenTimeout:      time.Minute,
+		},
+		FailurePolicy: FailCached,
+	}))
+
+	client := &mqtt.Client{ID: defaultClientID}
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"result":"allow","acl":["commands/#"]}`)),
+	}, nil).Times(1)
+	require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+	authHook.OnDisconnect(client, nil, false)
+
+	// let the cached decision expire, then trip the breaker
+	time.Sleep(5 * time.Millisecond)
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap")).Times(1)
+	require.False(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "other_client_id"}, packets.Packet{}))
+
+	// the reconnect is allowed from the cache and keeps the filters it was granted
+	reconnect := &mqtt.Client{ID: defaultClientID}
+	require.True(t, authHook.OnConnectAuthenticate(reconnect, packets.Packet{}))
+	require.True(t, authHook.OnACLCheck(reconnect, "commands/1/reboot", false))
+
+	// credentials that were never allowed are still denied
+	require.False(t, authHook.OnConnectAuthenticate(reconnect, packets.Packet{Connect: packets.ConnectParams{Password: []byte("other")}}))
+}
+
+func TestHTTPAuthHookServerErrorsNotCached(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Cache: CacheConfig{
+			Size:        10,
+			PositiveTTL: time.Millisecond,
+			NegativeTTL: time.Minute,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 1,
+			OpenTimeout:      time.Minute,
+		},
+		FailurePolicy: FailCached,
+	}))
+
+	client := &mqtt.Client{ID: defaultClientID}
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnACLCheck(client, "/topic", false))
+
+	// a 5xx fails the expired check and opens the breaker without replacing the cached allow
+	time.Sleep(5 * time.Millisecond)
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil).Times(1)
+	require.False(t, authHook.OnACLCheck(client, "/topic", false))
+	require.True(t, authHook.OnACLCheck(client, "/topic", false))
+
+	// nor is a failed connect cached as a denial that outlasts the outage, with the connect breaker out of the way
+	authHook.clientauthhosts.breaker = nil
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil).Times(1)
+	require.False(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+}
+
+func TestHTTPAuthHookBreakerPerEndpoint(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		SuperUserHost:            "http://superuserhost.com",
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 1,
+			OpenTimeout:      time.Minute,
+		},
+	}))
+
+	// the superuser endpoint is down while the ACL endpoint is healthy
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "superuserhost.com" {
+			return nil, errors.New("Oh Crap")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}).Times(3)
+
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+
+	// the open superuser breaker does not fail the ACL checks of other clients
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: "other_client_id"}, "/topic", false))
+}
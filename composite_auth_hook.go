@@ -0,0 +1,237 @@
+package mochicloudhooks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+)
+
+// AuthDecision is the result of an auth hook that may have no opinion about a client
+type AuthDecision int
+
+const (
+	// AuthAbstain leaves the decision to other hooks
+	AuthAbstain AuthDecision = iota
+	// AuthAllow allows the client
+	AuthAllow
+	// AuthDeny denies the client
+	AuthDeny
+)
+
+// ConnectDecider is implemented by auth hooks that can abstain from a connect decision. Other hooks
+// are taken to allow when OnConnectAuthenticate returns true and to deny otherwise
+type ConnectDecider interface {
+	DecideConnect(cl *mqtt.Client, pk packets.Packet) AuthDecision
+}
+
+// ACLDecider is implemented by auth hooks that can abstain from an ACL decision. Other hooks are taken
+// to allow when OnACLCheck returns true and to deny otherwise
+type ACLDecider interface {
+	DecideACL(cl *mqtt.Client, topic string, write bool) AuthDecision
+}
+
+// CompositeMode decides how the decisions of the hooks of a CompositeAuthHook are combined
+type CompositeMode int
+
+const (
+	// CompositeFirstAllow allows once any hook allows, asking the hooks in order
+	CompositeFirstAllow CompositeMode = iota
+	// CompositeFirstDeny denies once any hook denies, asking the hooks in order. A client no hook denies
+	// is allowed if at least one hook allowed it
+	CompositeFirstDeny
+	// CompositeAllMustAllow only allows if every hook allows, an abstaining hook denies
+	CompositeAllMustAllow
+)
+
+// CompositeAuthHook chains several auth hooks and combines their decisions with Mode, instead of mochi's
+// default of allowing whenever any hook allows. Besides auth, the hooks are given the disconnect,
+// subscribe, AUTH packet and packet encode events they provide
+type CompositeAuthHook struct {
+	hooks []mqtt.Hook
+	mode  CompositeMode
+	mqtt.HookBase
+}
+
+type CompositeAuthHookConfig struct {
+	Hooks []CompositeHook // hooks in the order they are asked
+	Mode  CompositeMode
+}
+
+// CompositeHook is a hook of a CompositeAuthHook and the config it is initialised with
+type CompositeHook struct {
+	Hook   mqtt.Hook
+	Config any
+}
+
+// compositeEvents are the events other than auth that are passed on to the hooks
+var compositeEvents = []byte{
+	mqtt.OnDisconnect,
+	mqtt.OnSubscribe,
+	mqtt.OnAuthPacket,
+	mqtt.OnPacketEncode,
+}
+
+func (h *CompositeAuthHook) ID() string {
+	return "composite-auth-hook"
+}
+
+func (h *CompositeAuthHook) Provides(b byte) bool {
+	if b != mqtt.OnACLCheck && b != mqtt.OnConnectAuthenticate && !bytes.Contains(compositeEvents, []byte{b}) {
+		return false
+	}
+
+	for _, hook := range h.hooks {
+		if hook.Provides(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *CompositeAuthHook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	compositeConfig, ok := config.(CompositeAuthHookConfig)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(compositeConfig.Hooks) == 0 {
+		return errors.New("no hooks configured")
+	}
+	if compositeConfig.Mode < CompositeFirstAllow || compositeConfig.Mode > CompositeAllMustAllow {
+		return errors.New("unknown composite mode")
+	}
+
+	log := zerolog.Nop()
+	if h.Log != nil {
+		log = *h.Log
+	}
+
+	for _, ch := range compositeConfig.Hooks {
+		hookLog := log.With().Str("hook", ch.Hook.ID()).Logger()
+		ch.Hook.SetOpts(&hookLog, h.Opts)
+
+		if err := ch.Hook.Init(ch.Config); err != nil {
+			// the hooks already initialised are not added to the server, so nothing else stops them
+			h.Stop()
+			h.hooks = nil
+			return fmt.Errorf("failed initialising %s hook: %w", ch.Hook.ID(), err)
+		}
+		h.hooks = append(h.hooks, ch.Hook)
+	}
+	h.mode = compositeConfig.Mode
+
+	return nil
+}
+
+// Stop stops the hooks in reverse order, returning the first error
+func (h *CompositeAuthHook) Stop() error {
+	var err error
+	for i := len(h.hooks) - 1; i >= 0; i-- {
+		if stopErr := h.hooks[i].Stop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+	return err
+}
+
+func (h *CompositeAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	return h.combine(mqtt.OnConnectAuthenticate, func(hook mqtt.Hook) AuthDecision {
+		if decider, ok := hook.(ConnectDecider); ok {
+			return decider.DecideConnect(cl, pk)
+		}
+		return boolDecision(hook.OnConnectAuthenticate(cl, pk))
+	})
+}
+
+func (h *CompositeAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.combine(mqtt.OnACLCheck, func(hook mqtt.Hook) AuthDecision {
+		if decider, ok := hook.(ACLDecider); ok {
+			return decider.DecideACL(cl, topic, write)
+		}
+		return boolDecision(hook.OnACLCheck(cl, topic, write))
+	})
+}
+
+func (h *CompositeAuthHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	for _, hook := range h.hooks {
+		if hook.Provides(mqtt.OnDisconnect) {
+			hook.OnDisconnect(cl, err, expire)
+		}
+	}
+}
+
+func (h *CompositeAuthHook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	for _, hook := range h.hooks {
+		if hook.Provides(mqtt.OnSubscribe) {
+			pk = hook.OnSubscribe(cl, pk)
+		}
+	}
+	return pk
+}
+
+func (h *CompositeAuthHook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	pkx := pk
+	for _, hook := range h.hooks {
+		if hook.Provides(mqtt.OnAuthPacket) {
+			npk, err := hook.OnAuthPacket(cl, pkx)
+			if err != nil {
+				return pk, err
+			}
+			pkx = npk
+		}
+	}
+	return pkx, nil
+}
+
+func (h *CompositeAuthHook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	for _, hook := range h.hooks {
+		if hook.Provides(mqtt.OnPacketEncode) {
+			pk = hook.OnPacketEncode(cl, pk)
+		}
+	}
+	return pk
+}
+
+// combine asks the hooks providing event for their decision and combines them according to the mode
+func (h *CompositeAuthHook) combine(event byte, decide func(hook mqtt.Hook) AuthDecision) bool {
+	allowed := false
+	for _, hook := range h.hooks {
+		if !hook.Provides(event) {
+			continue
+		}
+
+		decision := decide(hook)
+		switch h.mode {
+		case CompositeFirstAllow:
+			if decision == AuthAllow {
+				return true
+			}
+		case CompositeFirstDeny:
+			if decision == AuthDeny {
+				return false
+			}
+		case CompositeAllMustAllow:
+			if decision != AuthAllow {
+				return false
+			}
+		}
+		allowed = allowed || decision == AuthAllow
+	}
+
+	return allowed
+}
+
+func boolDecision(allowed bool) AuthDecision {
+	if allowed {
+		return AuthAllow
+	}
+	return AuthDeny
+}
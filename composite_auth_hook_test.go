@@ -0,0 +1,294 @@
+package mochicloudhooks
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// decisionHook is an auth hook that returns a fixed decision and records what it is asked
+type decisionHook struct {
+	id          string
+	decision    AuthDecision
+	initErr     error
+	asked       int
+	disconnects int
+	stopped     bool
+	mqtt.HookBase
+}
+
+func (h *decisionHook) ID() string {
+	return h.id
+}
+
+func (h *decisionHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+func (h *decisionHook) Init(config any) error {
+	return h.initErr
+}
+
+func (h *decisionHook) Stop() error {
+	h.stopped = true
+	return nil
+}
+
+func (h *decisionHook) DecideConnect(cl *mqtt.Client, pk packets.Packet) AuthDecision {
+	h.asked++
+	return h.decision
+}
+
+func (h *decisionHook) DecideACL(cl *mqtt.Client, topic string, write bool) AuthDecision {
+	h.asked++
+	return h.decision
+}
+
+func (h *decisionHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.disconnects++
+}
+
+// boolHook is an auth hook that only answers with a bool, as mochi's own hooks do
+type boolHook struct {
+	allow bool
+	mqtt.HookBase
+}
+
+func (h *boolHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate || b == mqtt.OnACLCheck
+}
+
+func (h *boolHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	return h.allow
+}
+
+func (h *boolHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.allow
+}
+
+func newTestCompositeAuthHook(t *testing.T, mode CompositeMode, hooks ...mqtt.Hook) *CompositeAuthHook {
+	config := CompositeAuthHookConfig{Mode: mode}
+	for _, hook := range hooks {
+		config.Hooks = append(config.Hooks, CompositeHook{Hook: hook})
+	}
+
+	authHook := new(CompositeAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(config))
+	return authHook
+}
+
+func TestCompositeAuthHookModes(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        CompositeMode
+		decisions   []AuthDecision
+		expectAllow bool
+		expectAsked []int
+	}{
+		{
+			name:        "Success - First Allow stops at allow",
+			mode:        CompositeFirstAllow,
+			decisions:   []AuthDecision{AuthDeny, AuthAllow, AuthDeny},
+			expectAllow: true,
+			expectAsked: []int{1, 1, 0},
+		},
+		{
+			name:        "Error - First Allow without allow",
+			mode:        CompositeFirstAllow,
+			decisions:   []AuthDecision{AuthAbstain, AuthDeny},
+			expectAsked: []int{1, 1},
+		},
+		{
+			name:        "Success - First Deny skips abstaining hooks",
+			mode:        CompositeFirstDeny,
+			decisions:   []AuthDecision{AuthAbstain, AuthAllow},
+			expectAllow: true,
+			expectAsked: []int{1, 1},
+		},
+		{
+			name:        "Error - First Deny stops at deny",
+			mode:        CompositeFirstDeny,
+			decisions:   []AuthDecision{AuthAllow, AuthDeny, AuthAllow},
+			expectAsked: []int{1, 1, 0},
+		},
+		{
+			name:        "Error - First Deny with every hook abstaining",
+			mode:        CompositeFirstDeny,
+			decisions:   []AuthDecision{AuthAbstain, AuthAbstain},
+			expectAsked: []int{1, 1},
+		},
+		{
+			name:        "Success - All Must Allow",
+			mode:        CompositeAllMustAllow,
+			decisions:   []AuthDecision{AuthAllow, AuthAllow},
+			expectAllow: true,
+			expectAsked: []int{1, 1},
+		},
+		{
+			name:        "Error - All Must Allow with abstaining hook",
+			mode:        CompositeAllMustAllow,
+			decisions:   []AuthDecision{AuthAllow, AuthAbstain, AuthAllow},
+			expectAsked: []int{1, 1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hooks []mqtt.Hook
+			var deciders []*decisionHook
+			for _, decision := range tt.decisions {
+				hook := &decisionHook{id: "decision", decision: decision}
+				hooks = append(hooks, hook)
+				deciders = append(deciders, hook)
+			}
+			authHook := newTestCompositeAuthHook(t, tt.mode, hooks...)
+
+			cl := &mqtt.Client{ID: defaultClientID}
+			require.Equal(t, tt.expectAllow, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+			for i, hook := range deciders {
+				require.Equal(t, tt.expectAsked[i], hook.asked)
+			}
+
+			require.Equal(t, tt.expectAllow, authHook.OnACLCheck(cl, "/topic", true))
+		})
+	}
+}
+
+func TestCompositeAuthHookBoolHooks(t *testing.T) {
+	// hooks without a decider allow or deny, they never abstain
+	authHook := newTestCompositeAuthHook(t, CompositeFirstDeny, &boolHook{allow: true}, &boolHook{allow: false})
+	require.False(t, authHook.OnConnectAuthenticate(&mqtt.Client{}, packets.Packet{}))
+
+	authHook = newTestCompositeAuthHook(t, CompositeAllMustAllow, &boolHook{allow: true}, &boolHook{allow: true})
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{}, "/topic", false))
+}
+
+func TestCompositeAuthHookLifecycle(t *testing.T) {
+	first := &decisionHook{id: "first"}
+	second := &decisionHook{id: "second"}
+	authHook := newTestCompositeAuthHook(t, CompositeFirstAllow, first, &boolHook{}, second)
+
+	require.True(t, authHook.Provides(mqtt.OnDisconnect))
+	require.False(t, authHook.Provides(mqtt.OnPacketEncode))
+	require.False(t, authHook.Provides(mqtt.OnPublish))
+
+	authHook.OnDisconnect(&mqtt.Client{}, nil, false)
+	require.Equal(t, 1, first.disconnects)
+	require.Equal(t, 1, second.disconnects)
+
+	require.NoError(t, authHook.Stop())
+	require.True(t, first.stopped)
+	require.True(t, second.stopped)
+
+	// hooks initialised before a failing hook are stopped
+	initialised := &decisionHook{id: "initialised"}
+	failed := new(CompositeAuthHook)
+	failed.Log = &zerolog.Logger{}
+	require.Error(t, failed.Init(CompositeAuthHookConfig{Hooks: []CompositeHook{
+		{Hook: initialised},
+		{Hook: &decisionHook{id: "failing", initErr: errors.New("failed")}},
+	}}))
+	require.True(t, initialised.stopped)
+
+	require.Error(t, failed.Init(nil))
+	require.Error(t, failed.Init("config"))
+	require.Error(t, failed.Init(CompositeAuthHookConfig{}))
+	require.Error(t, failed.Init(CompositeAuthHookConfig{Hooks: []CompositeHook{{Hook: &boolHook{}}}, Mode: 5}))
+}
+
+func TestCompositeAuthHookSuperusers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	hash := testPasswordHashes(t, "secret")["mosquitto"]
+	secrets := &testSecrets{}
+	secrets.set("users", `{"users": [
+		{"username": "admin", "password": "`+hash+`", "superuser": true},
+		{"username": "device", "password": "`+hash+`", "acl": {"publish": {"allow": ["#"]}}}
+	]}`)
+
+	authHook := new(CompositeAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(CompositeAuthHookConfig{
+		Mode: CompositeFirstDeny,
+		Hooks: []CompositeHook{
+			{
+				Hook: new(SecretManagerAuthHook),
+				Config: SecretManagerHookConfig{
+					Names:    []string{"users"},
+					Provider: secrets,
+					Mode:     SecretManagerModeSuperuserOnly,
+				},
+			},
+			{
+				Hook: new(HTTPAuthHook),
+				Config: HTTPAuthHookConfig{
+					RoundTripper:             mockRT,
+					ACLHost:                  "http://aclhost.com",
+					ClientAuthenticationHost: "http://clientauthenticationhost.com",
+				},
+			},
+		},
+	}))
+	defer authHook.Stop()
+
+	// the superuser is allowed by the secret manager hook and by the HTTP endpoint
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "admin"}, adminConnect("admin", "secret")))
+
+	// other users, including non superusers of the secrets, are left to the HTTP endpoint
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "device"}, adminConnect("device", "secret")))
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusUnauthorized}, nil).Times(1)
+	require.False(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "other"}, adminConnect("other", "secret")))
+}
+
+func TestSecretManagerAuthHookSuperuserOnly(t *testing.T) {
+	hash := testPasswordHashes(t, "secret")["mosquitto"]
+	secrets := &testSecrets{}
+	secrets.set("users", `{"users": [
+		{"username": "admin", "password": "`+hash+`", "superuser": true},
+		{"username": "device", "password": "`+hash+`", "acl": {"publish": {"allow": ["#"]}}}
+	]}`)
+
+	authHook := new(SecretManagerAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(SecretManagerHookConfig{
+		Names:    []string{"users"},
+		Provider: secrets,
+		Mode:     SecretManagerModeSuperuserOnly,
+	}))
+	defer authHook.Stop()
+
+	admin := &mqtt.Client{ID: "admin"}
+	require.Equal(t, AuthAllow, authHook.DecideConnect(admin, adminConnect("admin", "secret")))
+	require.Equal(t, AuthAllow, authHook.DecideACL(admin, "/topic", true))
+
+	device := &mqtt.Client{ID: "device"}
+	require.Equal(t, AuthAbstain, authHook.DecideConnect(device, adminConnect("admin", "wrong")))
+	require.Equal(t, AuthAbstain, authHook.DecideConnect(device, adminConnect("device", "secret")))
+	require.Equal(t, AuthAbstain, authHook.DecideConnect(device, adminConnect("other", "secret")))
+	require.Equal(t, AuthAbstain, authHook.DecideACL(device, "/topic", true))
+	require.False(t, authHook.OnACLCheck(device, "/topic", true))
+
+	// the default mode denies instead of abstaining
+	authoritative := new(SecretManagerAuthHook)
+	authoritative.Log = &zerolog.Logger{}
+	require.NoError(t, authoritative.Init(SecretManagerHookConfig{Names: []string{"users"}, Provider: secrets}))
+	defer authoritative.Stop()
+	require.Equal(t, AuthDeny, authoritative.DecideConnect(device, adminConnect("other", "secret")))
+	require.Equal(t, AuthDeny, authoritative.DecideACL(device, "/topic", true))
+}
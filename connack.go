@@ -0,0 +1,107 @@
+package mochicloudhooks
+
+import (
+	"net/http"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// connackReasonCodes are the MQTT v5 CONNACK reason codes an auth endpoint may ask for
+var connackReasonCodes = map[byte]packets.Code{
+	packets.ErrUnspecifiedError.Code:            packets.ErrUnspecifiedError,
+	packets.ErrImplementationSpecificError.Code: packets.ErrImplementationSpecificError,
+	packets.ErrClientIdentifierNotValid.Code:    packets.ErrClientIdentifierNotValid,
+	packets.ErrBadUsernameOrPassword.Code:       packets.ErrBadUsernameOrPassword,
+	packets.ErrNotAuthorized.Code:               packets.ErrNotAuthorized,
+	packets.ErrServerUnavailable.Code:           packets.ErrServerUnavailable,
+	packets.ErrServerBusy.Code:                  packets.ErrServerBusy,
+	packets.ErrBanned.Code:                      packets.ErrBanned,
+	packets.ErrBadAuthenticationMethod.Code:     packets.ErrBadAuthenticationMethod,
+	packets.ErrQuotaExceeded.Code:               packets.ErrQuotaExceeded,
+	packets.ErrConnectionRateExceeded.Code:      packets.ErrConnectionRateExceeded,
+	packets.ErrUseAnotherServer.Code:            packets.ErrUseAnotherServer,
+	packets.ErrServerMoved.Code:                 packets.ErrServerMoved,
+}
+
+// connectRejection is how a rejected connect is reported to the client in its CONNACK
+type connectRejection struct {
+	code            packets.Code
+	serverReference string
+}
+
+// rejectionFromStatus returns the rejection for a response status that denied a connect
+func rejectionFromStatus(status int) connectRejection {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return connectRejection{code: packets.ErrServerBusy}
+	case status >= http.StatusInternalServerError:
+		return connectRejection{code: packets.ErrServerUnavailable}
+	}
+
+	return connectRejection{code: packets.ErrBadUsernameOrPassword}
+}
+
+// rejectionFromResponse returns the rejection requested by a JSON response body, falling back to
+// the rejection for the response status if it names no valid CONNACK reason code
+func rejectionFromResponse(status int, authResp AuthResponse) connectRejection {
+	rejection := rejectionFromStatus(status)
+	if code, ok := connackReasonCodes[authResp.ReasonCode]; ok {
+		rejection.code = code
+	}
+	if authResp.ReasonString != "" {
+		rejection.code.Reason = authResp.ReasonString
+	}
+	rejection.serverReference = authResp.ServerReference
+
+	return rejection
+}
+
+// rejectConnect denies a connect, remembering how the rejection should be reported until the CONNACK is sent
+func (h *HTTPAuthHook) rejectConnect(cl *mqtt.Client, rejection connectRejection) bool {
+	h.rejectionLock.Lock()
+	defer h.rejectionLock.Unlock()
+
+	h.rejections[cl] = rejection
+	return false
+}
+
+// OnPacketEncode replaces the generic reason code of a CONNACK rejecting a client with the reason code,
+// reason string and server reference of the auth decision, and adds the result of enhanced
+// authentication. Clients connecting with MQTT v3 only get reason codes that have a v3 equivalent
+func (h *HTTPAuthHook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type != packets.Connack {
+		return pk
+	}
+
+	// the final data of an enhanced authentication exchange is sent with the CONNACK
+	if exchange, ok := h.completeExchange(cl); ok && pk.ReasonCode == packets.CodeSuccess.Code {
+		pk.Properties.AuthenticationMethod = exchange.method
+		pk.Properties.AuthenticationData = exchange.data
+	}
+
+	h.rejectionLock.Lock()
+	rejection, ok := h.rejections[cl]
+	delete(h.rejections, cl)
+	h.rejectionLock.Unlock()
+
+	// another hook may have allowed the client
+	if !ok || pk.ReasonCode < packets.ErrUnspecifiedError.Code && pk.ReasonCode != packets.Err3NotAuthorized.Code {
+		return pk
+	}
+
+	if cl.Properties.ProtocolVersion < 5 {
+		if v3, ok := packets.V5CodesToV3[connackReasonCodes[rejection.code.Code]]; ok {
+			pk.ReasonCode = v3.Code
+		}
+		return pk
+	}
+
+	pk.ReasonCode = rejection.code.Code
+	pk.Properties.ReasonString = rejection.code.Reason
+	if rejection.serverReference != "" {
+		pk.Properties.ServerReference = rejection.serverReference
+	}
+
+	return pk
+}
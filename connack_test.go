@@ -0,0 +1,209 @@
+package mochicloudhooks
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectedConnack is the CONNACK mochi sends when no hook authenticates a client
+func rejectedConnack(cl *mqtt.Client) packets.Packet {
+	code := packets.ErrBadUsernameOrPassword
+	if cl.Properties.ProtocolVersion < 5 {
+		code = packets.Err3NotAuthorized
+	}
+
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connack},
+		ReasonCode:  code.Code,
+		Properties:  packets.Properties{ReasonString: code.Reason},
+	}
+}
+
+func TestConnackReasonCodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name            string
+		protocolVersion byte
+		resp            *http.Response
+		err             error
+		expectCode      byte
+		expectReason    string
+		expectServerRef string
+	}{
+		{
+			name:            "Success - Unauthorized",
+			protocolVersion: 5,
+			resp:            &http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody},
+			expectCode:      packets.ErrBadUsernameOrPassword.Code,
+			expectReason:    packets.ErrBadUsernameOrPassword.Reason,
+		},
+		{
+			name:            "Success - Too Many Requests",
+			protocolVersion: 5,
+			resp:            &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody},
+			expectCode:      packets.ErrServerBusy.Code,
+			expectReason:    packets.ErrServerBusy.Reason,
+		},
+		{
+			name:            "Success - Endpoint Unreachable",
+			protocolVersion: 5,
+			err:             errors.New("Oh Crap"),
+			expectCode:      packets.ErrServerUnavailable.Code,
+			expectReason:    packets.ErrServerUnavailable.Reason,
+		},
+		{
+			name:            "Success - Use Another Server",
+			protocolVersion: 5,
+			resp: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"result": "deny", "reason_code": 156, "reason_string": "moving", "server_reference": "broker-2:1883"}`)),
+			},
+			expectCode:      packets.ErrUseAnotherServer.Code,
+			expectReason:    "moving",
+			expectServerRef: "broker-2:1883",
+		},
+		{
+			name:            "Success - Invalid Reason Code Ignored",
+			protocolVersion: 5,
+			resp: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"result": "deny", "reason_code": 4}`)),
+			},
+			expectCode:   packets.ErrBadUsernameOrPassword.Code,
+			expectReason: packets.ErrBadUsernameOrPassword.Reason,
+		},
+		{
+			name:            "Success - MQTT v3 Mapped",
+			protocolVersion: 4,
+			err:             errors.New("Oh Crap"),
+			expectCode:      packets.Err3ServerUnavailable.Code,
+		},
+		{
+			name:            "Success - MQTT v3 Without Equivalent",
+			protocolVersion: 4,
+			resp:            &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody},
+			expectCode:      packets.Err3NotAuthorized.Code,
+			expectReason:    packets.Err3NotAuthorized.Reason,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRT.EXPECT().RoundTrip(gomock.Any()).Return(tt.resp, tt.err)
+
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHost:                  "http://aclhost.com",
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+				ResponseMode:             ResponseModeJSON,
+			}))
+
+			cl := &mqtt.Client{ID: defaultClientID}
+			cl.Properties.ProtocolVersion = tt.protocolVersion
+			require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+			pk := authHook.OnPacketEncode(cl, rejectedConnack(cl))
+			require.Equal(t, tt.expectCode, pk.ReasonCode)
+			require.Equal(t, tt.expectReason, pk.Properties.ReasonString)
+			require.Equal(t, tt.expectServerRef, pk.Properties.ServerReference)
+		})
+	}
+}
+
+func TestConnackReasonCodesBlocked(t *testing.T) {
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+	}))
+	defer authHook.Stop()
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	cl.Properties.ProtocolVersion = 5
+	require.NoError(t, authHook.AddBlock("clientid:"+defaultClientID, time.Now().Add(time.Minute)))
+	require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	pk := authHook.OnPacketEncode(cl, rejectedConnack(cl))
+	require.Equal(t, packets.ErrBanned.Code, pk.ReasonCode)
+
+	// the rejection only applies to the CONNACK it was made for
+	pk = authHook.OnPacketEncode(cl, rejectedConnack(cl))
+	require.Equal(t, packets.ErrBadUsernameOrPassword.Code, pk.ReasonCode)
+}
+
+func TestConnackReasonCodesCached(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ResponseMode:             ResponseModeJSON,
+		Cache: CacheConfig{
+			Size:        10,
+			NegativeTTL: time.Minute,
+		},
+	}))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"result": "deny", "reason_code": 156, "server_reference": "broker-2:1883"}`)),
+	}, nil).Times(1)
+
+	// a repeated connect denied from the cache is rejected with the reason of the original
+	for i := 0; i < 2; i++ {
+		cl := &mqtt.Client{ID: defaultClientID}
+		cl.Properties.ProtocolVersion = 5
+		require.False(t, authHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+		pk := authHook.OnPacketEncode(cl, rejectedConnack(cl))
+		require.Equal(t, packets.ErrUseAnotherServer.Code, pk.ReasonCode)
+		require.Equal(t, "broker-2:1883", pk.Properties.ServerReference)
+	}
+}
+
+func TestConnackAllowedByAnotherHook(t *testing.T) {
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+	}))
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	cl.Properties.ProtocolVersion = 5
+	authHook.rejectConnect(cl, connectRejection{code: packets.ErrBanned})
+
+	pk := authHook.OnPacketEncode(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connack},
+		ReasonCode:  packets.CodeSuccess.Code,
+	})
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+
+	// other packets are left alone
+	pk = authHook.OnPacketEncode(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}})
+	require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+}
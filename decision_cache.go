@@ -0,0 +1,261 @@
+package mochicloudhooks
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// CacheConfig configures the caching of allow/deny decisions returned by the auth endpoints.
+// A TTL of zero disables caching of that kind of decision.
+type CacheConfig struct {
+	Size        int
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+}
+
+type decisionKind uint8
+
+const (
+	connectDecision decisionKind = iota
+	aclDecision
+)
+
+type decisionKey struct {
+	kind     decisionKind
+	clientID string
+	username string
+	topic    string
+	access   ACLAccess
+	secret   string
+}
+
+type decisionEntry struct {
+	key     decisionKey
+	allowed bool
+	details connectDetails
+	expires time.Time
+}
+
+// connectDetails are cached with a connect decision so a connect served from the cache is handled like the
+// original: an allowed connect is granted the same superuser status and topic filters, and a denied one is
+// rejected with the same reason
+type connectDetails struct {
+	superuser bool
+	acl       []string
+	rejection connectRejection
+}
+
+// decisionCache is a bounded LRU cache of auth decisions that can be invalidated per client
+type decisionCache struct {
+	mu          sync.Mutex
+	size        int
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	lru         *list.List
+	entries     map[decisionKey]*list.Element
+	clients     map[string]map[decisionKey]struct{}
+}
+
+func newDecisionCache(config CacheConfig) *decisionCache {
+	if config.Size <= 0 || (config.PositiveTTL <= 0 && config.NegativeTTL <= 0) {
+		return nil
+	}
+
+	return &decisionCache{
+		size:        config.Size,
+		positiveTTL: config.PositiveTTL,
+		negativeTTL: config.NegativeTTL,
+		lru:         list.New(),
+		entries:     make(map[decisionKey]*list.Element),
+		clients:     make(map[string]map[decisionKey]struct{}),
+	}
+}
+
+func connectDecisionKey(clientID, username string, password []byte) decisionKey {
+	sum := sha256.Sum256(password)
+	return decisionKey{
+		kind:     connectDecision,
+		clientID: clientID,
+		username: username,
+		secret:   hex.EncodeToString(sum[:]),
+	}
+}
+
+func aclDecisionKey(clientID, username, topic string, access ACLAccess) decisionKey {
+	return decisionKey{
+		kind:     aclDecision,
+		clientID: clientID,
+		username: username,
+		topic:    topic,
+		access:   access,
+	}
+}
+
+// get returns the cached decision for key and whether an unexpired decision was found
+func (c *decisionCache) get(key decisionKey) (allowed bool, ok bool) {
+	allowed, _, ok = c.getConnect(key)
+	return allowed, ok
+}
+
+// getConnect returns the cached decision for key with the connect details stored alongside it
+func (c *decisionCache) getConnect(key decisionKey) (allowed bool, details connectDetails, ok bool) {
+	if c == nil {
+		return false, connectDetails{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[key]
+	if !found {
+		return false, connectDetails{}, false
+	}
+
+	// expired entries are kept until evicted so they can still be served by getStale
+	entry := el.Value.(*decisionEntry)
+	if time.Now().After(entry.expires) {
+		return false, connectDetails{}, false
+	}
+
+	c.lru.MoveToFront(el)
+	return entry.allowed, entry.details, true
+}
+
+// getStale returns the cached decision for key with its connect details even if it has expired
+func (c *decisionCache) getStale(key decisionKey) (allowed bool, details connectDetails, ok bool) {
+	if c == nil {
+		return false, connectDetails{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[key]
+	if !found {
+		return false, connectDetails{}, false
+	}
+
+	entry := el.Value.(*decisionEntry)
+	return entry.allowed, entry.details, true
+}
+
+// set stores a decision for key, evicting the least recently used entry if the cache is full
+func (c *decisionCache) set(key decisionKey, allowed bool) {
+	c.setWithTTL(key, allowed, 0)
+}
+
+// setWithTTL stores a decision for key using ttl instead of the configured TTL when ttl is positive
+func (c *decisionCache) setWithTTL(key decisionKey, allowed bool, ttl time.Duration) {
+	c.setConnect(key, allowed, ttl, connectDetails{})
+}
+
+// setConnect stores a decision for key like setWithTTL, along with the details of the connect
+func (c *decisionCache) setConnect(key decisionKey, allowed bool, ttl time.Duration, details connectDetails) {
+	if c == nil {
+		return
+	}
+
+	if ttl <= 0 {
+		ttl = c.negativeTTL
+		if allowed {
+			ttl = c.positiveTTL
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.entries[key]; found {
+		entry := el.Value.(*decisionEntry)
+		entry.allowed = allowed
+		entry.details = details
+		entry.expires = time.Now().Add(ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&decisionEntry{
+		key:     key,
+		allowed: allowed,
+		details: details,
+		expires: time.Now().Add(ttl),
+	})
+
+	keys, ok := c.clients[key.clientID]
+	if !ok {
+		keys = make(map[decisionKey]struct{})
+		c.clients[key.clientID] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// invalidateClientACL drops the ACL decisions cached for the client. Connect decisions are keyed by the
+// credentials as well, so they are kept for the client to reconnect with
+func (c *decisionCache) invalidateClientACL(clientID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.clients[clientID] {
+		if key.kind != aclDecision {
+			continue
+		}
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// invalidateDeniedConnects drops every cached connect denial. The cache is not keyed by block key, so
+// lifting any block drops them all
+func (c *decisionCache) invalidateDeniedConnects() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		if key.kind == connectDecision && !el.Value.(*decisionEntry).allowed {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *decisionCache) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// remove must be called with the lock held
+func (c *decisionCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*decisionEntry)
+	delete(c.entries, entry.key)
+
+	if keys, ok := c.clients[entry.key.clientID]; ok {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.clients, entry.key.clientID)
+		}
+	}
+}
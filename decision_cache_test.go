@@ -0,0 +1,191 @@
+package mochicloudhooks
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDecisionCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      CacheConfig
+		expectCache bool
+	}{
+		{
+			name:        "Success - Cache configured",
+			config:      CacheConfig{Size: 10, PositiveTTL: time.Minute},
+			expectCache: true,
+		},
+		{
+			name:        "Success - Zero size disables cache",
+			config:      CacheConfig{PositiveTTL: time.Minute},
+			expectCache: false,
+		},
+		{
+			name:        "Success - Zero TTLs disable cache",
+			config:      CacheConfig{Size: 10},
+			expectCache: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newDecisionCache(tt.config)
+			require.Equal(t, tt.expectCache, cache != nil)
+		})
+	}
+}
+
+func TestDecisionCacheGetSet(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       CacheConfig
+		allowed      bool
+		wait         time.Duration
+		expectCached bool
+	}{
+		{
+			name:         "Success - Positive decision cached",
+			config:       CacheConfig{Size: 10, PositiveTTL: time.Minute},
+			allowed:      true,
+			expectCached: true,
+		},
+		{
+			name:         "Success - Negative decision cached",
+			config:       CacheConfig{Size: 10, NegativeTTL: time.Minute},
+			allowed:      false,
+			expectCached: true,
+		},
+		{
+			name:         "Success - Negative decision not cached without negative TTL",
+			config:       CacheConfig{Size: 10, PositiveTTL: time.Minute},
+			allowed:      false,
+			expectCached: false,
+		},
+		{
+			name:         "Success - Expired decision not returned",
+			config:       CacheConfig{Size: 10, PositiveTTL: time.Millisecond},
+			allowed:      true,
+			wait:         5 * time.Millisecond,
+			expectCached: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newDecisionCache(tt.config)
+			key := aclDecisionKey(defaultClientID, "username", "/topic", ACLAccessSubscribe)
+
+			cache.set(key, tt.allowed)
+			time.Sleep(tt.wait)
+
+			allowed, ok := cache.get(key)
+			require.Equal(t, tt.expectCached, ok)
+			if ok {
+				require.Equal(t, tt.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	cache := newDecisionCache(CacheConfig{Size: 2, PositiveTTL: time.Minute})
+
+	first := aclDecisionKey(defaultClientID, "", "/first", ACLAccessSubscribe)
+	second := aclDecisionKey(defaultClientID, "", "/second", ACLAccessSubscribe)
+	third := aclDecisionKey(defaultClientID, "", "/third", ACLAccessSubscribe)
+
+	cache.set(first, true)
+	cache.set(second, true)
+
+	// touch first so second becomes the least recently used entry
+	_, ok := cache.get(first)
+	require.True(t, ok)
+
+	cache.set(third, true)
+	require.Equal(t, 2, cache.len())
+
+	_, ok = cache.get(second)
+	require.False(t, ok)
+	_, ok = cache.get(first)
+	require.True(t, ok)
+	_, ok = cache.get(third)
+	require.True(t, ok)
+}
+
+func TestDecisionCacheInvalidateClientACL(t *testing.T) {
+	cache := newDecisionCache(CacheConfig{Size: 10, PositiveTTL: time.Minute, NegativeTTL: time.Minute})
+
+	cache.set(aclDecisionKey(defaultClientID, "", "/topic", ACLAccessSubscribe), true)
+	cache.set(connectDecisionKey(defaultClientID, "", []byte("password")), true)
+	cache.set(aclDecisionKey("other_client_id", "", "/topic", ACLAccessSubscribe), false)
+
+	cache.invalidateClientACL(defaultClientID)
+
+	require.Equal(t, 2, cache.len())
+	_, ok := cache.get(aclDecisionKey(defaultClientID, "", "/topic", ACLAccessSubscribe))
+	require.False(t, ok)
+	_, ok = cache.get(connectDecisionKey(defaultClientID, "", []byte("password")))
+	require.True(t, ok)
+	_, ok = cache.get(aclDecisionKey("other_client_id", "", "/topic", ACLAccessSubscribe))
+	require.True(t, ok)
+}
+
+func TestDecisionCacheConnectKey(t *testing.T) {
+	require.Equal(t, connectDecisionKey(defaultClientID, "username", []byte("password")),
+		connectDecisionKey(defaultClientID, "username", []byte("password")))
+	require.NotEqual(t, connectDecisionKey(defaultClientID, "username", []byte("password")),
+		connectDecisionKey(defaultClientID, "username", []byte("other")))
+}
+
+func TestHTTPAuthHookCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	err := authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Cache: CacheConfig{
+			Size:        10,
+			PositiveTTL: time.Minute,
+			NegativeTTL: time.Minute,
+		},
+	})
+	require.NoError(t, err)
+
+	client := &mqtt.Client{ID: defaultClientID}
+
+	// one request per distinct decision, repeated checks are served from the cache
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(2)
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusTeapot}, nil).Times(1)
+
+	require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+	require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+
+	for i := 0; i < 5; i++ {
+		require.True(t, authHook.OnACLCheck(client, "/topic", true))
+	}
+	for i := 0; i < 5; i++ {
+		require.False(t, authHook.OnACLCheck(client, "/topic", false))
+	}
+
+	// disconnecting invalidates the client's ACL decisions
+	authHook.OnDisconnect(client, nil, false)
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnACLCheck(client, "/topic", true))
+
+	// while a reconnect with the same credentials is served from the cache
+	reconnect := &mqtt.Client{ID: defaultClientID}
+	require.True(t, authHook.OnConnectAuthenticate(reconnect, packets.Packet{}))
+}
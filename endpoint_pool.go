@@ -0,0 +1,163 @@
+package mochicloudhooks
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Endpoint is one replica of an auth endpoint
+type Endpoint struct {
+	URL    string
+	Weight int // relative share of requests with WeightedBalancing, defaults to 1
+}
+
+// BalancingStrategy decides which endpoint of a pool is tried first
+type BalancingStrategy int
+
+const (
+	// RoundRobinBalancing spreads requests evenly across the healthy endpoints
+	RoundRobinBalancing BalancingStrategy = iota
+	// WeightedBalancing spreads requests across the healthy endpoints in proportion to their weight
+	WeightedBalancing
+)
+
+// LoadBalancingConfig configures how requests are spread across multiple endpoints and when
+// an endpoint is considered unhealthy
+type LoadBalancingConfig struct {
+	Strategy         BalancingStrategy
+	FailureThreshold int           // consecutive failures before an endpoint is ejected, defaults to 3
+	EjectionDuration time.Duration // how long an ejected endpoint is skipped before it is probed again, defaults to 30 seconds
+}
+
+type poolEndpoint struct {
+	url           string
+	weight        int
+	currentWeight int
+	failures      int
+	ejectedUntil  time.Time
+}
+
+// endpointPool selects endpoints for a single check type, passively tracking their health
+type endpointPool struct {
+	mu               sync.Mutex
+	endpoints        []*poolEndpoint
+	strategy         BalancingStrategy
+	failureThreshold int
+	ejectionDuration time.Duration
+	next             int
+	breaker          *circuitBreaker
+}
+
+func newEndpointPool(host string, hosts []Endpoint, config LoadBalancingConfig) *endpointPool {
+	if host != "" {
+		hosts = append([]Endpoint{{URL: host}}, hosts...)
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	pool := &endpointPool{
+		strategy:         config.Strategy,
+		failureThreshold: config.FailureThreshold,
+		ejectionDuration: config.EjectionDuration,
+	}
+	if pool.failureThreshold <= 0 {
+		pool.failureThreshold = 3
+	}
+	if pool.ejectionDuration <= 0 {
+		pool.ejectionDuration = 30 * time.Second
+	}
+
+	for _, h := range hosts {
+		weight := h.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.endpoints = append(pool.endpoints, &poolEndpoint{
+			url:    h.URL,
+			weight: weight,
+		})
+	}
+
+	return pool
+}
+
+// order returns the endpoints in the order they should be tried for one check. The selected endpoint
+// comes first followed by the other healthy endpoints. Ejected endpoints come last so a check is only
+// denied when every endpoint has failed
+func (p *endpointPool) order() []*poolEndpoint {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var healthy, ejected []*poolEndpoint
+	for i := range p.endpoints {
+		// rotate the starting point so failover traffic is spread as well
+		e := p.endpoints[(p.next+i)%len(p.endpoints)]
+		if now.Before(e.ejectedUntil) {
+			ejected = append(ejected, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	p.next = (p.next + 1) % len(p.endpoints)
+
+	if len(healthy) > 0 && p.strategy == WeightedBalancing {
+		selected := p.selectWeighted(healthy)
+		ordered := []*poolEndpoint{selected}
+		for _, e := range healthy {
+			if e != selected {
+				ordered = append(ordered, e)
+			}
+		}
+		healthy = ordered
+	}
+
+	// endpoints closest to being probed again are tried first
+	sort.SliceStable(ejected, func(i, j int) bool {
+		return ejected[i].ejectedUntil.Before(ejected[j].ejectedUntil)
+	})
+
+	return append(healthy, ejected...)
+}
+
+// selectWeighted implements smooth weighted round robin, must be called with the lock held
+func (p *endpointPool) selectWeighted(endpoints []*poolEndpoint) *poolEndpoint {
+	var (
+		total    int
+		selected *poolEndpoint
+	)
+
+	for _, e := range endpoints {
+		e.currentWeight += e.weight
+		total += e.weight
+		if selected == nil || e.currentWeight > selected.currentWeight {
+			selected = e
+		}
+	}
+	selected.currentWeight -= total
+
+	return selected
+}
+
+// report records the outcome of a request to the endpoint, ejecting it after too many consecutive failures
+func (p *endpointPool) report(e *poolEndpoint, success bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if success {
+		e.failures = 0
+		e.ejectedUntil = time.Time{}
+		return
+	}
+
+	e.failures++
+	if e.failures >= p.failureThreshold {
+		e.ejectedUntil = time.Now().Add(p.ejectionDuration)
+	}
+}
@@ -0,0 +1,171 @@
+package mochicloudhooks
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func poolURLs(endpoints []*poolEndpoint) []string {
+	urls := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		urls[i] = e.url
+	}
+	return urls
+}
+
+func TestNewEndpointPool(t *testing.T) {
+	require.Nil(t, newEndpointPool("", nil, LoadBalancingConfig{}))
+
+	pool := newEndpointPool("http://a", []Endpoint{{URL: "http://b", Weight: 3}}, LoadBalancingConfig{})
+	require.Equal(t, []string{"http://a", "http://b"}, poolURLs(pool.endpoints))
+	require.Equal(t, 1, pool.endpoints[0].weight)
+	require.Equal(t, 3, pool.endpoints[1].weight)
+}
+
+func TestEndpointPoolRoundRobin(t *testing.T) {
+	pool := newEndpointPool("", []Endpoint{{URL: "a"}, {URL: "b"}, {URL: "c"}}, LoadBalancingConfig{})
+
+	require.Equal(t, []string{"a", "b", "c"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"b", "c", "a"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"c", "a", "b"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"a", "b", "c"}, poolURLs(pool.order()))
+}
+
+func TestEndpointPoolWeighted(t *testing.T) {
+	pool := newEndpointPool("", []Endpoint{{URL: "a", Weight: 3}, {URL: "b", Weight: 1}}, LoadBalancingConfig{
+		Strategy: WeightedBalancing,
+	})
+
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		counts[pool.order()[0].url]++
+	}
+
+	require.Equal(t, 300, counts["a"])
+	require.Equal(t, 100, counts["b"])
+}
+
+func TestEndpointPoolEjection(t *testing.T) {
+	pool := newEndpointPool("", []Endpoint{{URL: "a"}, {URL: "b"}}, LoadBalancingConfig{
+		FailureThreshold: 2,
+		EjectionDuration: 10 * time.Millisecond,
+	})
+	a := pool.endpoints[0]
+
+	pool.report(a, false)
+	require.Equal(t, []string{"a", "b"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"b", "a"}, poolURLs(pool.order()))
+
+	// ejected endpoints are moved to the back
+	pool.report(a, false)
+	require.Equal(t, []string{"b", "a"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"b", "a"}, poolURLs(pool.order()))
+
+	// and probed again once the ejection has passed
+	time.Sleep(15 * time.Millisecond)
+	require.Equal(t, []string{"a", "b"}, poolURLs(pool.order()))
+	require.Equal(t, []string{"b", "a"}, poolURLs(pool.order()))
+
+	pool.report(a, true)
+	require.Zero(t, a.failures)
+}
+
+func TestHTTPAuthHookFailover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name       string
+		responses  map[string]func() (*http.Response, error)
+		expectPass bool
+	}{
+		{
+			name: "Success - Fails over on transport error",
+			responses: map[string]func() (*http.Response, error){
+				"acl-a.com": func() (*http.Response, error) { return nil, errors.New("Oh Crap") },
+				"acl-b.com": func() (*http.Response, error) { return &http.Response{StatusCode: http.StatusOK}, nil },
+			},
+			expectPass: true,
+		},
+		{
+			name: "Success - Fails over on 5xx",
+			responses: map[string]func() (*http.Response, error){
+				"acl-a.com": func() (*http.Response, error) { return &http.Response{StatusCode: http.StatusBadGateway}, nil },
+				"acl-b.com": func() (*http.Response, error) { return &http.Response{StatusCode: http.StatusOK}, nil },
+			},
+			expectPass: true,
+		},
+		{
+			name: "Failure - Denial is not failed over",
+			responses: map[string]func() (*http.Response, error){
+				"acl-a.com": func() (*http.Response, error) { return &http.Response{StatusCode: http.StatusTeapot}, nil },
+			},
+			expectPass: false,
+		},
+		{
+			name: "Error - All endpoints failing",
+			responses: map[string]func() (*http.Response, error){
+				"acl-a.com": func() (*http.Response, error) { return nil, errors.New("Oh Crap") },
+				"acl-b.com": func() (*http.Response, error) { return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil },
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHosts:                 []Endpoint{{URL: "http://acl-a.com"}, {URL: "http://acl-b.com"}},
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+			}))
+
+			mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+				return tt.responses[r.URL.Host]()
+			}).Times(len(tt.responses))
+
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+		})
+	}
+}
+
+func TestHTTPAuthHookFailoverDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHosts:                 []Endpoint{{URL: "http://acl-a.com"}, {URL: "http://acl-b.com"}, {URL: "http://acl-c.com"}},
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		LoadBalancing:            LoadBalancingConfig{FailureThreshold: 1},
+		RequestTimeout:           RequestTimeoutConfig{ACL: 20 * time.Millisecond},
+	}))
+
+	// a check running out of time only counts against the endpoint it was waiting on
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}).Times(1)
+	require.False(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+
+	var ejected int
+	for _, e := range authHook.aclhosts.endpoints {
+		if time.Now().Before(e.ejectedUntil) {
+			ejected++
+		}
+	}
+	require.Equal(t, 1, ejected)
+}
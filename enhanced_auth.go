@@ -0,0 +1,314 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// EnhancedAuthConfig configures MQTT v5 enhanced authentication, where a client names an authentication
+// method in CONNECT and exchanges AUTH packets with the endpoint until it is authenticated
+type EnhancedAuthConfig struct {
+	Methods     []string      // authentication methods relayed to the endpoint, all methods when empty
+	StepTimeout time.Duration // how long the client has to answer each challenge, defaults to 30 seconds
+	MaxSteps    int           // challenges sent before the exchange is denied, defaults to 10
+}
+
+// EnhancedAuthPOST is sent to the enhanced authentication endpoint for every step of an exchange.
+// Data is the base64 encoded authentication data of the client and State is whatever the endpoint
+// returned in the previous step
+type EnhancedAuthPOST struct {
+	ClientID       string `json:"clientid"`
+	Username       string `json:"username"`
+	Method         string `json:"method"`
+	Data           string `json:"data"`
+	State          string `json:"state"`
+	Reauthenticate bool   `json:"reauthenticate"`
+}
+
+func (p EnhancedAuthPOST) fields() map[string]any {
+	return map[string]any{
+		"clientid":       p.ClientID,
+		"username":       p.Username,
+		"method":         p.Method,
+		"data":           p.Data,
+		"state":          p.State,
+		"reauthenticate": p.Reauthenticate,
+	}
+}
+
+// EnhancedAuthResponse is the body returned by the enhanced authentication endpoint
+type EnhancedAuthResponse struct {
+	Result       string `json:"result"`        // "continue", "allow" or "deny"
+	Data         string `json:"data"`          // base64 encoded challenge, or final data sent with the CONNACK or AUTH on allow
+	State        string `json:"state"`         // opaque state sent back with the next step
+	ReasonString string `json:"reason_string"` // sent to the client with the challenge or denial
+}
+
+const (
+	enhancedAuthContinue = "continue"
+	enhancedAuthAllow    = "allow"
+)
+
+// authExchange is the state of an enhanced authentication exchange of a client
+type authExchange struct {
+	method string
+	state  string
+	steps  int
+	data   []byte // latest data of the endpoint, the final data is sent with the CONNACK
+	done   bool
+}
+
+// errAuthDenied is returned when the endpoint denies an exchange
+var errAuthDenied = errors.New("enhanced authentication denied")
+
+// methodAllowed reports whether the authentication method is relayed to the endpoint
+func (c EnhancedAuthConfig) methodAllowed(method string) bool {
+	if len(c.Methods) == 0 {
+		return true
+	}
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateEnhanced runs the enhanced authentication exchange of a connecting client. The exchange
+// happens before the CONNACK, so the hook reads the client's AUTH packets from the connection itself
+func (h *HTTPAuthHook) authenticateEnhanced(cl *mqtt.Client, pk packets.Packet) bool {
+	method := pk.Properties.AuthenticationMethod
+	if h.enhancedauthhosts == nil || !h.enhancedAuth.methodAllowed(method) {
+		return h.rejectConnect(cl, connectRejection{code: packets.ErrBadAuthenticationMethod})
+	}
+
+	exchange := &authExchange{method: method}
+	h.authLock.Lock()
+	h.authExchanges[cl] = exchange
+	h.authLock.Unlock()
+
+	// each request has its own deadline, the time the client takes to answer is bounded by StepTimeout
+	// and MaxSteps
+	data := pk.Properties.AuthenticationData
+	for {
+		ctx, cancel := withTimeout(h.ctx, h.timeouts.ClientAuthentication)
+		authResp, err := h.authStep(ctx, cl, exchange, data, false)
+		cancel()
+		if err != nil {
+			h.endExchange(cl)
+			return h.rejectConnect(cl, enhancedAuthRejection(err, authResp))
+		}
+
+		if exchange.done {
+			return true
+		}
+
+		data, err = h.challenge(cl, exchange, authResp)
+		if err != nil {
+			h.Log.Error().Err(err).Str("client", cl.ID).Msg("enhanced authentication failed")
+			h.endExchange(cl)
+			return h.rejectConnect(cl, connectRejection{code: packets.ErrNotAuthorized})
+		}
+	}
+}
+
+// challenge sends the endpoint's challenge to a connecting client and returns the data of its answer
+func (h *HTTPAuthHook) challenge(cl *mqtt.Client, exchange *authExchange, authResp EnhancedAuthResponse) ([]byte, error) {
+	if err := h.writeAuth(cl, packets.CodeContinueAuthentication, exchange, authResp.ReasonString); err != nil {
+		return nil, err
+	}
+
+	if cl.Net.Conn == nil {
+		return nil, errors.New("client has no connection")
+	}
+	if err := cl.Net.Conn.SetReadDeadline(time.Now().Add(h.enhancedAuth.StepTimeout)); err != nil {
+		return nil, err
+	}
+	// mochi sets its own keepalive deadline once the client is attached
+	defer cl.Net.Conn.SetReadDeadline(time.Time{})
+
+	fh := new(packets.FixedHeader)
+	if err := cl.ReadFixedHeader(fh); err != nil {
+		return nil, err
+	}
+	if fh.Type != packets.Auth {
+		return nil, fmt.Errorf("expected auth packet, got packet type %d", fh.Type)
+	}
+
+	pk, err := cl.ReadPacket(fh)
+	if err != nil {
+		return nil, err
+	}
+	if pk.ReasonCode != packets.CodeContinueAuthentication.Code || pk.Properties.AuthenticationMethod != exchange.method {
+		return nil, packets.ErrProtocolViolationInvalidReason
+	}
+
+	return pk.Properties.AuthenticationData, nil
+}
+
+// OnAuthPacket handles re-authentication of a connected client. A client starts it with a re-authenticate
+// AUTH packet naming the method it connected with, and answers each challenge with a continue AUTH packet
+func (h *HTTPAuthHook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.authLock.Lock()
+	exchange, ok := h.authExchanges[cl]
+	h.authLock.Unlock()
+
+	switch pk.ReasonCode {
+	case packets.CodeReAuthenticate.Code:
+		// re-authentication must use the method of the connect, which the CONNACK has confirmed
+		method := cl.Properties.Props.AuthenticationMethod
+		if method == "" || pk.Properties.AuthenticationMethod != method {
+			return pk, packets.ErrProtocolViolation
+		}
+		exchange = &authExchange{method: method}
+		h.authLock.Lock()
+		h.authExchanges[cl] = exchange
+		h.authLock.Unlock()
+
+	case packets.CodeContinueAuthentication.Code:
+		if !ok || exchange.done || pk.Properties.AuthenticationMethod != exchange.method {
+			return pk, packets.ErrProtocolViolation
+		}
+
+	default:
+		return pk, packets.ErrProtocolViolation
+	}
+
+	ctx, cancel := withTimeout(h.clientContext(cl), h.timeouts.ClientAuthentication)
+	defer cancel()
+
+	authResp, err := h.authStep(ctx, cl, exchange, pk.Properties.AuthenticationData, true)
+	if err != nil {
+		h.endExchange(cl)
+		return pk, enhancedAuthRejection(err, authResp).code
+	}
+
+	code := packets.CodeContinueAuthentication
+	if exchange.done {
+		h.endExchange(cl)
+		code = packets.CodeSuccess
+	}
+
+	if err := h.writeAuth(cl, code, exchange, authResp.ReasonString); err != nil {
+		h.endExchange(cl)
+		return pk, err
+	}
+
+	return pk, nil
+}
+
+// authStep relays the client's authentication data to the endpoint. The exchange is marked done when the
+// endpoint allows it, and an error is returned when it is denied or fails
+func (h *HTTPAuthHook) authStep(ctx context.Context, cl *mqtt.Client, exchange *authExchange, data []byte, reauth bool) (EnhancedAuthResponse, error) {
+	exchange.steps++
+	if exchange.steps > h.enhancedAuth.MaxSteps {
+		return EnhancedAuthResponse{}, fmt.Errorf("%w: too many steps", errAuthDenied)
+	}
+
+	payload := EnhancedAuthPOST{
+		ClientID:       cl.ID,
+		Username:       string(cl.Properties.Username),
+		Method:         exchange.method,
+		Data:           base64.StdEncoding.EncodeToString(data),
+		State:          exchange.state,
+		Reauthenticate: reauth,
+	}
+
+	resp, err := h.makeRequest(ctx, h.enhancedauthrequest, h.enhancedauthhosts, payload, newRequestTemplateData(cl, packets.Packet{}))
+	if err != nil {
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("enhanced auth request failed")
+		return EnhancedAuthResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		h.blockClient(cl)
+		return EnhancedAuthResponse{}, errAuthDenied
+	}
+
+	body := io.LimitReader(resp.Body, maxResponseBodySize)
+	defer io.Copy(io.Discard, body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return EnhancedAuthResponse{}, errAuthDenied
+	}
+
+	var authResp EnhancedAuthResponse
+	if err := json.NewDecoder(body).Decode(&authResp); err != nil {
+		return EnhancedAuthResponse{}, fmt.Errorf("failed to decode enhanced auth response: %w", err)
+	}
+
+	switch authResp.Result {
+	case enhancedAuthContinue:
+	case enhancedAuthAllow:
+		exchange.done = true
+	default:
+		return authResp, errAuthDenied
+	}
+
+	exchange.state = authResp.State
+	exchange.data, err = base64.StdEncoding.DecodeString(authResp.Data)
+	if err != nil {
+		return EnhancedAuthResponse{}, fmt.Errorf("invalid enhanced auth data: %w", err)
+	}
+
+	return authResp, nil
+}
+
+// writeAuth sends an AUTH packet carrying the latest data of the endpoint to the client
+func (h *HTTPAuthHook) writeAuth(cl *mqtt.Client, code packets.Code, exchange *authExchange, reason string) error {
+	return cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Auth,
+		},
+		ReasonCode: code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: exchange.method,
+			AuthenticationData:   exchange.data,
+			ReasonString:         reason,
+		},
+	})
+}
+
+// completeExchange returns the finished exchange of a connecting client so its result can be sent with the CONNACK
+func (h *HTTPAuthHook) completeExchange(cl *mqtt.Client) (*authExchange, bool) {
+	h.authLock.Lock()
+	defer h.authLock.Unlock()
+
+	exchange, ok := h.authExchanges[cl]
+	if !ok || !exchange.done {
+		return nil, false
+	}
+	delete(h.authExchanges, cl)
+
+	return exchange, true
+}
+
+func (h *HTTPAuthHook) endExchange(cl *mqtt.Client) {
+	h.authLock.Lock()
+	defer h.authLock.Unlock()
+
+	delete(h.authExchanges, cl)
+}
+
+// enhancedAuthRejection returns how a failed exchange is reported to the client
+func enhancedAuthRejection(err error, authResp EnhancedAuthResponse) connectRejection {
+	if !errors.Is(err, errAuthDenied) {
+		return connectRejection{code: packets.ErrServerUnavailable}
+	}
+
+	code := packets.ErrNotAuthorized
+	if authResp.ReasonString != "" {
+		code.Reason = authResp.ReasonString
+	}
+	return connectRejection{code: code}
+}
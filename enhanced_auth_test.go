@@ -0,0 +1,300 @@
+package mochicloudhooks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// testMQTTClient speaks just enough MQTT v5 to run an enhanced authentication exchange against a broker
+type testMQTTClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestMQTTClient(t *testing.T, hook *HTTPAuthHook, config HTTPAuthHookConfig) *testMQTTClient {
+	server := mqtt.New(&mqtt.Options{Logger: &zerolog.Logger{}})
+	require.NoError(t, server.AddHook(hook, config))
+
+	clientConn, serverConn := net.Pipe()
+	go server.EstablishConnection("test", serverConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		hook.Stop()
+	})
+
+	return &testMQTTClient{
+		t:    t,
+		conn: clientConn,
+		r:    bufio.NewReader(clientConn),
+	}
+}
+
+func (c *testMQTTClient) write(pk packets.Packet) {
+	pk.ProtocolVersion = 5
+	buf := new(bytes.Buffer)
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		require.NoError(c.t, pk.ConnectEncode(buf))
+	case packets.Auth:
+		require.NoError(c.t, pk.AuthEncode(buf))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := c.conn.Write(buf.Bytes())
+	require.NoError(c.t, err)
+}
+
+func (c *testMQTTClient) read() packets.Packet {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	b, err := c.r.ReadByte()
+	require.NoError(c.t, err)
+
+	pk := packets.Packet{ProtocolVersion: 5}
+	require.NoError(c.t, pk.FixedHeader.Decode(b))
+	pk.FixedHeader.Remaining, _, err = packets.DecodeLength(c.r)
+	require.NoError(c.t, err)
+
+	body := make([]byte, pk.FixedHeader.Remaining)
+	_, err = io.ReadFull(c.r, body)
+	require.NoError(c.t, err)
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		require.NoError(c.t, pk.ConnackDecode(body))
+	case packets.Auth:
+		require.NoError(c.t, pk.AuthDecode(body))
+	case packets.Disconnect:
+		require.NoError(c.t, pk.DisconnectDecode(body))
+	}
+
+	return pk
+}
+
+func (c *testMQTTClient) connect(method string, data []byte) {
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: defaultClientID,
+		},
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	})
+}
+
+func (c *testMQTTClient) auth(code packets.Code, method string, data []byte) {
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	})
+}
+
+// scramBackend answers enhanced authentication requests with a single challenge before allowing
+func scramBackend(t *testing.T, mockRT *MockRoundTripper, reauth bool) {
+	steps := []struct {
+		expectData  string
+		expectState string
+		resp        string
+	}{
+		{
+			expectData: "client-first",
+			resp:       `{"result": "continue", "data": "` + base64.StdEncoding.EncodeToString([]byte("server-first")) + `", "state": "s1"}`,
+		},
+		{
+			expectData:  "client-final",
+			expectState: "s1",
+			resp:        `{"result": "allow", "data": "` + base64.StdEncoding.EncodeToString([]byte("server-final")) + `"}`,
+		},
+	}
+
+	for _, step := range steps {
+		step := step
+		mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+			require.Equal(t, "http://enhancedauthhost.com", r.URL.String())
+			if err := r.Context().Err(); err != nil {
+				return nil, err
+			}
+
+			var payload EnhancedAuthPOST
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			data, err := base64.StdEncoding.DecodeString(payload.Data)
+			require.NoError(t, err)
+			require.Equal(t, step.expectData, string(data))
+			require.Equal(t, step.expectState, payload.State)
+			require.Equal(t, "SCRAM-SHA-256", payload.Method)
+			require.Equal(t, reauth, payload.Reauthenticate)
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(step.resp)),
+			}, nil
+		})
+	}
+}
+
+func enhancedAuthConfig(mockRT http.RoundTripper) HTTPAuthHookConfig {
+	return HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		EnhancedAuthHost:         "http://enhancedauthhost.com",
+		EnhancedAuth: EnhancedAuthConfig{
+			Methods: []string{"SCRAM-SHA-256"},
+		},
+	}
+}
+
+func TestEnhancedAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	client := newTestMQTTClient(t, authHook, enhancedAuthConfig(mockRT))
+
+	scramBackend(t, mockRT, false)
+	client.connect("SCRAM-SHA-256", []byte("client-first"))
+
+	pk := client.read()
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, "SCRAM-SHA-256", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("server-first"), pk.Properties.AuthenticationData)
+
+	client.auth(packets.CodeContinueAuthentication, "SCRAM-SHA-256", []byte("client-final"))
+
+	pk = client.read()
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, "SCRAM-SHA-256", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("server-final"), pk.Properties.AuthenticationData)
+
+	// the exchange is forgotten once the client is connected
+	authHook.authLock.Lock()
+	require.Empty(t, authHook.authExchanges)
+	authHook.authLock.Unlock()
+
+	// re-authentication runs the same exchange over AUTH packets
+	scramBackend(t, mockRT, true)
+	client.auth(packets.CodeReAuthenticate, "SCRAM-SHA-256", []byte("client-first"))
+
+	pk = client.read()
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, []byte("server-first"), pk.Properties.AuthenticationData)
+
+	client.auth(packets.CodeContinueAuthentication, "SCRAM-SHA-256", []byte("client-final"))
+
+	pk = client.read()
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, []byte("server-final"), pk.Properties.AuthenticationData)
+}
+
+func TestEnhancedAuthDenied(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	client := newTestMQTTClient(t, authHook, enhancedAuthConfig(mockRT))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"result": "deny", "reason_string": "invalid proof"}`)),
+	}, nil)
+	client.connect("SCRAM-SHA-256", []byte("client-first"))
+
+	pk := client.read()
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrNotAuthorized.Code, pk.ReasonCode)
+	require.Equal(t, "invalid proof", pk.Properties.ReasonString)
+}
+
+func TestEnhancedAuthBadMethod(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	client := newTestMQTTClient(t, authHook, enhancedAuthConfig(mockRT))
+
+	// methods that are not configured are rejected without a request
+	client.connect("KERBEROS", nil)
+
+	pk := client.read()
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrBadAuthenticationMethod.Code, pk.ReasonCode)
+}
+
+func TestEnhancedAuthStepTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	config := enhancedAuthConfig(mockRT)
+	config.EnhancedAuth.StepTimeout = 20 * time.Millisecond
+
+	authHook := new(HTTPAuthHook)
+	client := newTestMQTTClient(t, authHook, config)
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"result": "continue"}`)),
+	}, nil)
+	client.connect("SCRAM-SHA-256", []byte("client-first"))
+	require.Equal(t, packets.Auth, client.read().FixedHeader.Type)
+
+	// a client that never answers the challenge is rejected
+	pk := client.read()
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrNotAuthorized.Code, pk.ReasonCode)
+}
+
+func TestEnhancedAuthRequestTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	config := enhancedAuthConfig(mockRT)
+	config.RequestTimeout.ClientAuthentication = 30 * time.Millisecond
+
+	authHook := new(HTTPAuthHook)
+	client := newTestMQTTClient(t, authHook, config)
+
+	scramBackend(t, mockRT, false)
+	client.connect("SCRAM-SHA-256", []byte("client-first"))
+	require.Equal(t, packets.Auth, client.read().FixedHeader.Type)
+
+	// the request timeout applies to each request, not to the time the client takes to answer
+	time.Sleep(50 * time.Millisecond)
+	client.auth(packets.CodeContinueAuthentication, "SCRAM-SHA-256", []byte("client-final"))
+
+	pk := client.read()
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+}
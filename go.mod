@@ -9,6 +9,7 @@ require (
 	github.com/mochi-co/mqtt/v2 v2.2.7
 	github.com/rs/zerolog v1.29.0
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/crypto v0.7.0
 )
 
 require (
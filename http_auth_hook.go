@@ -2,11 +2,12 @@ package mochicloudhooks
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
@@ -15,22 +16,110 @@ import (
 )
 
 type HTTPAuthHook struct {
-	httpclient     *http.Client
-	timeout        TimeoutConfig
-	timeoutLock    sync.Mutex
-	clientBlockMap map[string]time.Time
-	aclhost        string
-	clientauthhost string
-	superuserhost  string // currently unused
+	httpclient          *http.Client
+	timeout             TimeoutConfig
+	blocks              BlockStore
+	ownedBlocks         *MemoryBlockStore
+	aclhosts            *endpointPool
+	clientauthhosts     *endpointPool
+	superuserhosts      *endpointPool
+	enhancedauthhosts   *endpointPool
+	batchhosts          *endpointPool
+	aclrequest          *endpointRequest
+	clientauthrequest   *endpointRequest
+	superuserrequest    *endpointRequest
+	enhancedauthrequest *endpointRequest
+	batchrequest        *endpointRequest
+	batcher             *aclBatcher
+	enhancedAuth        EnhancedAuthConfig
+	cache               *decisionCache
+	failurePolicy       FailurePolicy
+	sessionLock         sync.Mutex
+	superusers          map[*mqtt.Client]bool
+	sessionACLs         map[*mqtt.Client][]string
+	responseMode        ResponseMode
+	subscribeAccess     ACLAccess
+	timeouts            RequestTimeoutConfig
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	clientCtxLock       sync.Mutex
+	clientCtx           map[*mqtt.Client]clientContext
+	rejectionLock       sync.Mutex
+	rejections          map[*mqtt.Client]connectRejection
+	authLock            sync.Mutex
+	authExchanges       map[*mqtt.Client]*authExchange
+	batchLock           sync.Mutex
+	prefetched          map[*mqtt.Client]map[prefetchKey]bool
 	mqtt.HookBase
 }
 
 type HTTPAuthHookConfig struct {
-	Timeout                  TimeoutConfig
-	ACLHost                  string
-	SuperUserHost            string
-	ClientAuthenticationHost string // currently unused
-	RoundTripper             http.RoundTripper
+	Timeout                     TimeoutConfig
+	ACLHost                     string
+	SuperUserHost               string
+	ClientAuthenticationHost    string
+	RoundTripper                http.RoundTripper
+	Cache                       CacheConfig
+	Retry                       RetryConfig
+	CircuitBreaker              CircuitBreakerConfig
+	FailurePolicy               FailurePolicy
+	RequestTimeout              RequestTimeoutConfig
+	ResponseMode                ResponseMode
+	ACLRequest                  RequestConfig
+	ClientAuthenticationRequest RequestConfig
+	SuperUserRequest            RequestConfig
+	Headers                     map[string]string
+	TokenSource                 TokenSource
+	Signing                     SigningConfig
+	TLS                         TLSConfig
+	ACLHosts                    []Endpoint // additional ACL endpoints used alongside ACLHost
+	SuperUserHosts              []Endpoint // additional superuser endpoints used alongside SuperUserHost
+	ClientAuthenticationHosts   []Endpoint // additional client authentication endpoints used alongside ClientAuthenticationHost
+	LoadBalancing               LoadBalancingConfig
+	BlockStore                  BlockStore // where blocked clients are kept when Timeout is set, defaults to a MemoryBlockStore
+	SubscribeAccess             ACLAccess  // access sent when checking a subscription, defaults to ACLAccessSubscribe
+	EnhancedAuthHost            string     // relays MQTT v5 enhanced authentication, which is rejected when no host is set
+	EnhancedAuthHosts           []Endpoint // additional enhanced authentication endpoints used alongside EnhancedAuthHost
+	EnhancedAuthRequest         RequestConfig
+	EnhancedAuth                EnhancedAuthConfig
+	ACLBatch                    ACLBatchConfig
+}
+
+// ResponseMode decides how the responses of the auth endpoints are interpreted
+type ResponseMode int
+
+const (
+	// ResponseModeStatusCode allows a request on any 2xx response
+	ResponseModeStatusCode ResponseMode = iota
+	// ResponseModeJSON additionally requires a 2xx response body of AuthResponse with an allow result
+	ResponseModeJSON
+)
+
+// maxResponseBodySize limits how much of a response body is read
+const maxResponseBodySize = 1 << 20
+
+// AuthResponse is the body returned by the auth endpoints when ResponseModeJSON is used
+type AuthResponse struct {
+	Result    string   `json:"result"`    // "allow" or "deny"
+	Superuser bool     `json:"superuser"` // connect only, skips the superuser endpoint for the session
+	ACL       []string `json:"acl"`       // connect only, topic filters the client may use without further ACL requests
+	TTL       int      `json:"ttl"`       // seconds the decision may be cached, overriding the configured TTL
+
+	// connect only, MQTT v5 CONNACK reason code, reason string and server reference sent to a denied client
+	ReasonCode      byte   `json:"reason_code"`
+	ReasonString    string `json:"reason_string"`
+	ServerReference string `json:"server_reference"`
+}
+
+// RequestTimeoutConfig sets the deadline of each request by endpoint. A zero value means no deadline
+type RequestTimeoutConfig struct {
+	ClientAuthentication time.Duration // also applies to each request of an enhanced authentication exchange
+	ACL                  time.Duration // also applies to the superuser check
+}
+
+type clientContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type SuperuserCheckPOST struct {
@@ -44,14 +133,49 @@ type ClientCheckPOST struct {
 }
 
 type ACLCheckPOST struct {
-	Username string `json:"username"`
-	ClientID string `json:"clientid"`
-	Topic    string `json:"topic"`
-	ACC      string `json:"acc"`
+	Username string    `json:"username"`
+	ClientID string    `json:"clientid"`
+	Topic    string    `json:"topic"`
+	ACC      ACLAccess `json:"acc"`
 }
 
+// ACLAccess is the kind of access an ACL check asks for, using the numeric acc codes of mosquitto
+type ACLAccess int
+
+const (
+	// ACLAccessRead asks whether the client may receive messages on a topic
+	ACLAccessRead ACLAccess = 1
+	// ACLAccessWrite asks whether the client may publish to a topic
+	ACLAccessWrite ACLAccess = 2
+	// ACLAccessSubscribe asks whether the client may subscribe to a topic filter
+	ACLAccessSubscribe ACLAccess = 4
+)
+
+// TimeoutConfig configures blocking of clients rejected by the auth endpoints
 type TimeoutConfig struct {
-	TimeoutDuration time.Duration
+	TimeoutDuration  time.Duration
+	SweepInterval    time.Duration   // how often the default block store removes expired blocks, defaults to 1 minute
+	BlockKeys        []BlockKey      // what is blocked, each entry is tracked separately, defaults to BlockByClientID
+	FailureThreshold int             // rejections within FailureWindow before blocking, defaults to 1
+	FailureWindow    time.Duration   // how long a rejection counts towards FailureThreshold, defaults to 1 minute
+	Escalation       []time.Duration // block durations for repeated blocks, the last is used once exhausted, defaults to TimeoutDuration
+	EscalationReset  time.Duration   // how long after its last block a key starts again from the first duration, defaults to 1 hour
+}
+
+// enabled reports whether blocking has been configured
+func (tc TimeoutConfig) enabled() bool {
+	return tc.TimeoutDuration > 0 || len(tc.Escalation) > 0
+}
+
+// blockDuration returns the duration of the nth block of a key, counting from 1
+func (tc TimeoutConfig) blockDuration(n int64) time.Duration {
+	if len(tc.Escalation) == 0 {
+		return tc.TimeoutDuration
+	}
+	if n > int64(len(tc.Escalation)) {
+		n = int64(len(tc.Escalation))
+	}
+	return tc.Escalation[n-1]
 }
 
 func (h *HTTPAuthHook) ID() string {
@@ -59,9 +183,20 @@ func (h *HTTPAuthHook) ID() string {
 }
 
 func (h *HTTPAuthHook) Provides(b byte) bool {
+	// AUTH packets are left to other hooks unless enhanced authentication is configured
+	if b == mqtt.OnAuthPacket {
+		return h.enhancedauthhosts != nil
+	}
+	// the filters of a SUBSCRIBE are only collected when a batch endpoint is configured
+	if b == mqtt.OnSubscribe {
+		return h.batchhosts != nil
+	}
+
 	return bytes.Contains([]byte{
 		mqtt.OnACLCheck,
 		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+		mqtt.OnPacketEncode,
 	}, []byte{b})
 }
 
@@ -79,22 +214,162 @@ func (h *HTTPAuthHook) Init(config any) error {
 		return errors.New("hostname configs failed validation")
 	}
 
-	if (authHookConfig.Timeout != TimeoutConfig{}) {
+	aclrequest, err := newEndpointRequest(authHookConfig.ACLRequest)
+	if err != nil {
+		return err
+	}
+	clientauthrequest, err := newEndpointRequest(authHookConfig.ClientAuthenticationRequest)
+	if err != nil {
+		return err
+	}
+	superuserrequest, err := newEndpointRequest(authHookConfig.SuperUserRequest)
+	if err != nil {
+		return err
+	}
+	enhancedauthrequest, err := newEndpointRequest(authHookConfig.EnhancedAuthRequest)
+	if err != nil {
+		return err
+	}
+	// batch requests always carry a JSON list of checks
+	batchrequest, err := newEndpointRequest(RequestConfig{})
+	if err != nil {
+		return err
+	}
+
+	if authHookConfig.Timeout.enabled() {
 		h.timeout = authHookConfig.Timeout
-		h.clientBlockMap = make(map[string]time.Time)
+		if len(h.timeout.BlockKeys) == 0 {
+			h.timeout.BlockKeys = []BlockKey{BlockByClientID}
+		}
+		if h.timeout.FailureThreshold <= 0 {
+			h.timeout.FailureThreshold = 1
+		}
+		if h.timeout.FailureWindow <= 0 {
+			h.timeout.FailureWindow = time.Minute
+		}
+		if h.timeout.EscalationReset <= 0 {
+			h.timeout.EscalationReset = time.Hour
+		}
+		h.blocks = authHookConfig.BlockStore
+		if h.blocks == nil {
+			sweepInterval := h.timeout.SweepInterval
+			if sweepInterval <= 0 {
+				sweepInterval = time.Minute
+			}
+			h.ownedBlocks = NewMemoryBlockStore(sweepInterval)
+			h.blocks = h.ownedBlocks
+		}
+	}
+	if err := authHookConfig.Signing.validate(); err != nil {
+		return err
 	}
-	h.httpclient = NewTransport(authHookConfig.RoundTripper)
 
-	h.aclhost = authHookConfig.ACLHost
-	h.clientauthhost = authHookConfig.ClientAuthenticationHost
-	h.superuserhost = authHookConfig.SuperUserHost
+	rt := authHookConfig.RoundTripper
+	if authHookConfig.TLS.Enabled() {
+		tlsTransport, err := newTLSTransport(rt, authHookConfig.TLS)
+		if err != nil {
+			return err
+		}
+		rt = tlsTransport
+	}
+	if authHookConfig.Signing.Enabled() {
+		rt = &SigningTransport{
+			OriginalTransport: rt,
+			Signing:           authHookConfig.Signing,
+		}
+	}
+	if len(authHookConfig.Headers) > 0 || authHookConfig.TokenSource != nil {
+		rt = &AuthTransport{
+			OriginalTransport: rt,
+			Headers:           authHookConfig.Headers,
+			TokenSource:       authHookConfig.TokenSource,
+		}
+	}
+	h.httpclient = NewTransport(&Transport{
+		OriginalTransport: rt,
+		Retry:             authHookConfig.Retry,
+	})
+	h.cache = newDecisionCache(authHookConfig.Cache)
+	h.failurePolicy = authHookConfig.FailurePolicy
+
+	h.aclhosts = newEndpointPool(authHookConfig.ACLHost, authHookConfig.ACLHosts, authHookConfig.LoadBalancing)
+	h.clientauthhosts = newEndpointPool(authHookConfig.ClientAuthenticationHost, authHookConfig.ClientAuthenticationHosts, authHookConfig.LoadBalancing)
+	h.superuserhosts = newEndpointPool(authHookConfig.SuperUserHost, authHookConfig.SuperUserHosts, authHookConfig.LoadBalancing)
+	h.enhancedauthhosts = newEndpointPool(authHookConfig.EnhancedAuthHost, authHookConfig.EnhancedAuthHosts, authHookConfig.LoadBalancing)
+	h.aclrequest = aclrequest
+	h.clientauthrequest = clientauthrequest
+	h.superuserrequest = superuserrequest
+	h.enhancedauthrequest = enhancedauthrequest
+	h.batchhosts = newEndpointPool(authHookConfig.ACLBatch.Host, authHookConfig.ACLBatch.Hosts, authHookConfig.LoadBalancing)
+	h.batchrequest = batchrequest
+	h.initBreakers(authHookConfig.CircuitBreaker)
+	if h.batchhosts != nil && authHookConfig.ACLBatch.Window > 0 {
+		h.batcher = &aclBatcher{
+			hook:    h,
+			window:  authHookConfig.ACLBatch.Window,
+			maxSize: authHookConfig.ACLBatch.MaxSize,
+		}
+		if h.batcher.maxSize <= 0 {
+			h.batcher.maxSize = 100
+		}
+	}
+	h.enhancedAuth = authHookConfig.EnhancedAuth
+	if h.enhancedAuth.StepTimeout <= 0 {
+		h.enhancedAuth.StepTimeout = 30 * time.Second
+	}
+	if h.enhancedAuth.MaxSteps <= 0 {
+		h.enhancedAuth.MaxSteps = 10
+	}
+	h.superusers = make(map[*mqtt.Client]bool)
+	h.sessionACLs = make(map[*mqtt.Client][]string)
+	h.responseMode = authHookConfig.ResponseMode
+	h.subscribeAccess = authHookConfig.SubscribeAccess
+	if h.subscribeAccess == 0 {
+		h.subscribeAccess = ACLAccessSubscribe
+	}
+
+	h.timeouts = authHookConfig.RequestTimeout
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.clientCtx = make(map[*mqtt.Client]clientContext)
+	h.rejections = make(map[*mqtt.Client]connectRejection)
+	h.authExchanges = make(map[*mqtt.Client]*authExchange)
+	h.prefetched = make(map[*mqtt.Client]map[prefetchKey]bool)
+	return nil
+}
+
+// Stop cancels all in-flight requests and stops the default block store. A configured BlockStore is left
+// open as it may be shared
+func (h *HTTPAuthHook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.ownedBlocks != nil {
+		return h.ownedBlocks.Close()
+	}
 	return nil
 }
 
 func (h *HTTPAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	// check if client blocked
-	if h.checkIfClientBlocked(cl.ID) {
-		return false
+	if h.checkIfClientBlocked(cl) {
+		return h.rejectConnect(cl, connectRejection{code: packets.ErrBanned})
+	}
+
+	// MQTT v5 clients naming an authentication method authenticate through AUTH packets
+	if pk.ProtocolVersion == 5 && pk.Properties.AuthenticationMethod != "" {
+		return h.authenticateEnhanced(cl, pk)
+	}
+
+	key := connectDecisionKey(cl.ID, string(pk.Connect.Username), pk.Connect.Password)
+	if allowed, details, ok := h.cache.getConnect(key); ok {
+		// a denial served from the cache is rejected with the reason of the original
+		if !allowed {
+			return h.rejectConnect(cl, details.rejection)
+		}
+		if h.responseMode == ResponseModeJSON {
+			h.grantSession(cl, details)
+		}
+		return true
 	}
 
 	payload := ClientCheckPOST{
@@ -103,109 +378,446 @@ func (h *HTTPAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet)
 		Username: string(pk.Connect.Username),
 	}
 
-	resp, err := h.makeRequest(http.MethodPost, h.clientauthhost, payload)
+	// the client is not attached yet so the request is only tied to the lifetime of the hook
+	ctx, cancel := withTimeout(h.ctx, h.timeouts.ClientAuthentication)
+	defer cancel()
+
+	resp, err := h.makeRequest(ctx, h.clientauthrequest, h.clientauthhosts, payload, newRequestTemplateData(cl, pk))
 	if err != nil {
-		h.Log.Error().Err(err)
-		return false
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("client authentication request failed")
+		if h.failureDecision(key, err) {
+			// a reconnect allowed from a stale decision keeps the grants cached with it
+			if allowed, details, ok := h.cache.getStale(key); ok && allowed && h.responseMode == ResponseModeJSON {
+				h.grantSession(cl, details)
+			}
+			return true
+		}
+		return h.rejectConnect(cl, connectRejection{code: packets.ErrServerUnavailable})
 	}
+	defer resp.Body.Close()
 
 	// Block on proper 4xx response
 	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		h.blockClient(cl.ID)
-		return false
+		h.blockClient(cl)
+		rejection := rejectionFromStatus(resp.StatusCode)
+		h.cache.setConnect(key, false, 0, connectDetails{rejection: rejection})
+		return h.rejectConnect(cl, rejection)
+	}
+
+	allowed, authResp := h.readResponse(resp)
+	details := connectDetails{superuser: authResp.Superuser, acl: authResp.ACL}
+	if !allowed {
+		// a JSON body denying the client counts towards a block like a 401 or 403
+		if authResp.Result != "" {
+			h.blockClient(cl)
+		}
+		details.rejection = rejectionFromResponse(resp.StatusCode, authResp)
+	}
+	h.cache.setConnect(key, allowed, ttlHint(authResp), details)
+	if !allowed {
+		return h.rejectConnect(cl, details.rejection)
+	}
+
+	if h.responseMode == ResponseModeJSON {
+		h.grantSession(cl, details)
 	}
 
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
+	return allowed
 }
 
 func (h *HTTPAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 	// check if client blocked
-	if h.checkIfClientBlocked(cl.ID) {
+	if h.checkIfClientBlocked(cl) {
 		return false
 	}
 
+	// topic filters granted at connect are checked locally
+	if h.checkSessionACL(cl, topic) {
+		return true
+	}
+
+	// superusers skip the per topic check for the rest of their session
+	if h.checkSuperuser(cl) {
+		return true
+	}
+
+	// mochi only checks ACLs on publish and subscribe, every filter of a SUBSCRIBE is checked on its own
+	access := h.subscribeAccess
+	if write {
+		access = ACLAccessWrite
+	}
+
+	key := aclDecisionKey(cl.ID, string(cl.Properties.Username), topic, access)
+	if allowed, ok := h.takePrefetched(cl, topic, access); ok {
+		return allowed
+	}
+	if allowed, ok := h.cache.get(key); ok {
+		return allowed
+	}
+
 	payload := ACLCheckPOST{
 		ClientID: cl.ID,
 		Username: string(cl.Properties.Username),
 		Topic:    topic,
-		ACC:      strconv.FormatBool(write),
+		ACC:      access,
 	}
 
-	resp, err := h.makeRequest(http.MethodPost, h.aclhost, payload)
+	ctx, cancel := withTimeout(h.clientContext(cl), h.timeouts.ACL)
+	defer cancel()
+
+	if h.batcher != nil {
+		authResp, err := h.batcher.check(ctx, payload)
+		if err == nil {
+			allowed := authResp.Result == "allow"
+			h.cache.setWithTTL(key, allowed, ttlHint(authResp))
+			return allowed
+		}
+		// a failed batch falls back to checking on its own
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("acl batch request failed")
+	}
+
+	resp, err := h.makeRequest(ctx, h.aclrequest, h.aclhosts, payload, newACLTemplateData(cl, topic, payload.ACC))
 	if err != nil {
-		h.Log.Error().Err(err)
-		return false
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("acl request failed")
+		return h.failureDecision(key, err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		h.blockClient(cl.ID)
+		// a denied filter only fails its own entry in the SUBACK, it does not block the other filters
+		if write {
+			h.blockClient(cl)
+		}
+		h.cache.set(key, false)
 		return false
 	}
 
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
+	allowed, authResp := h.readResponse(resp)
+	h.cache.setWithTTL(key, allowed, ttlHint(authResp))
+	return allowed
+}
+
+// OnDisconnect cancels the client's in-flight requests and drops the ACL decisions and grants cached for it
+func (h *HTTPAuthHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.clientCtxLock.Lock()
+	if cc, ok := h.clientCtx[cl]; ok {
+		cc.cancel()
+		delete(h.clientCtx, cl)
+	}
+	h.clientCtxLock.Unlock()
+
+	h.cache.invalidateClientACL(cl.ID)
+	h.endExchange(cl)
+
+	h.batchLock.Lock()
+	delete(h.prefetched, cl)
+	h.batchLock.Unlock()
+
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	delete(h.superusers, cl)
+	delete(h.sessionACLs, cl)
 }
 
-func (h *HTTPAuthHook) makeRequest(requestType, url string, payload any) (*http.Response, error) {
-	var buffer io.Reader
-	if payload == nil {
-		buffer = http.NoBody
-	} else {
-		rb, err := json.Marshal(payload)
+// grantSession records the superuser status and topic filters granted to the client at connect
+func (h *HTTPAuthHook) grantSession(cl *mqtt.Client, details connectDetails) {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+
+	if details.superuser {
+		h.superusers[cl] = true
+	}
+	h.sessionACLs[cl] = details.acl
+}
+
+// checkSessionACL reports whether the topic is covered by a filter granted to the client at connect
+func (h *HTTPAuthHook) checkSessionACL(cl *mqtt.Client, topic string) bool {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+
+	for _, filter := range h.sessionACLs[cl] {
+		if matchTopicFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkSuperuser asks the superuser endpoint once per connection whether the client is a superuser
+func (h *HTTPAuthHook) checkSuperuser(cl *mqtt.Client) bool {
+	// superuser status granted at connect applies even without a superuser endpoint
+	h.sessionLock.Lock()
+	superuser, ok := h.superusers[cl]
+	h.sessionLock.Unlock()
+	if ok {
+		return superuser
+	}
+
+	// Exit early if no superuser endpoint was configured
+	if h.superuserhosts == nil {
+		return false
+	}
+
+	payload := SuperuserCheckPOST{
+		Username: string(cl.Properties.Username),
+	}
+
+	ctx, cancel := withTimeout(h.clientContext(cl), h.timeouts.ACL)
+	defer cancel()
+
+	resp, err := h.makeRequest(ctx, h.superuserrequest, h.superuserhosts, payload, newRequestTemplateData(cl, packets.Packet{}))
+	if err != nil {
+		h.Log.Error().Err(err).Str("client", cl.ID).Msg("superuser request failed")
+		return false
+	}
+	defer resp.Body.Close()
+
+	allowed, authResp := h.readResponse(resp)
+	superuser = allowed || authResp.Superuser
+
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	h.superusers[cl] = superuser
+
+	return superuser
+}
+
+// clientContext returns a context that is cancelled when the client disconnects or the hook stops.
+// It is keyed by client rather than client id so a session takeover does not cancel the new connection
+func (h *HTTPAuthHook) clientContext(cl *mqtt.Client) context.Context {
+	h.clientCtxLock.Lock()
+	defer h.clientCtxLock.Unlock()
+
+	if cc, ok := h.clientCtx[cl]; ok {
+		return cc.ctx
+	}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	h.clientCtx[cl] = clientContext{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	return ctx
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// makeRequest sends the check to the endpoints of the pool in turn until one of them answers without a
+// transport error or 5xx, so a single unhealthy replica does not fail the check. An error is returned if
+// none of them does
+func (h *HTTPAuthHook) makeRequest(ctx context.Context, er *endpointRequest, pool *endpointPool, payload requestPayload, data RequestTemplateData) (*http.Response, error) {
+	if pool == nil {
+		return nil, errors.New("no endpoints configured")
+	}
+
+	if !pool.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for _, endpoint := range pool.order() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		var req *http.Request
+		req, err = er.newRequest(ctx, endpoint.url, payload, data)
 		if err != nil {
-			h.Log.Err(err).Msg("")
+			pool.breaker.release()
+			h.Log.Error().Err(err).Str("endpoint", endpoint.url).Msg("failed to build auth request")
 			return nil, err
 		}
-		buffer = bytes.NewBuffer(rb)
+
+		resp, err = h.httpclient.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			pool.report(endpoint, true)
+			pool.breaker.record(true)
+			return resp, nil
+		}
+
+		// a cancelled check says nothing about the health of the endpoint
+		if errors.Is(ctx.Err(), context.Canceled) {
+			pool.breaker.release()
+			return nil, ctx.Err()
+		}
+
+		pool.report(endpoint, false)
+		if err != nil {
+			h.Log.Error().Err(err).Str("endpoint", endpoint.url).Msg("auth request failed")
+		}
+
+		// the remaining endpoints would fail at once with the expired context, so they are not tried
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
-	req, err := http.NewRequest(requestType, url, buffer)
-	if err != nil {
-		h.Log.Error().Err(err)
-		return nil, err
+	pool.breaker.record(false)
+
+	// a 5xx from every endpoint is an outage of the auth service rather than an answer, so it is not
+	// handed back as a response that could be cached as a denial
+	if err == nil && resp != nil {
+		resp.Body.Close()
+		err = fmt.Errorf("auth endpoint returned status %d", resp.StatusCode)
 	}
+	return nil, err
+}
 
-	resp, err := h.httpclient.Do(req)
-	if err != nil {
-		h.Log.Error().Err(err)
-		return nil, err
+// readResponse reads the body of a response and returns whether it allowed the request
+func (h *HTTPAuthHook) readResponse(resp *http.Response) (bool, AuthResponse) {
+	body := io.LimitReader(resp.Body, maxResponseBodySize)
+	defer io.Copy(io.Discard, body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, AuthResponse{}
+	}
+
+	if h.responseMode != ResponseModeJSON {
+		return true, AuthResponse{}
+	}
+
+	var authResp AuthResponse
+	if err := json.NewDecoder(body).Decode(&authResp); err != nil {
+		h.Log.Error().Err(err).Msg("failed to decode auth response")
+		return false, AuthResponse{}
 	}
 
-	return resp, nil
+	return authResp.Result == "allow", authResp
 }
 
-func (h *HTTPAuthHook) checkIfClientBlocked(client string) bool {
-	// Exit early if timeout was not configured and thusly client block map has not been created
-	if (h.timeout == TimeoutConfig{}) {
+// ttlHint returns the cache TTL requested by a response, zero if none was requested
+func ttlHint(authResp AuthResponse) time.Duration {
+	return time.Duration(authResp.TTL) * time.Second
+}
+
+// failureDecision decides a check that could not reach the endpoint, applying the failure policy while the breaker is open
+func (h *HTTPAuthHook) failureDecision(key decisionKey, err error) bool {
+	if !errors.Is(err, errCircuitOpen) {
 		return false
 	}
 
-	h.timeoutLock.Lock()
-	defer h.timeoutLock.Unlock()
+	switch h.failurePolicy {
+	case FailOpen:
+		return true
+	case FailCached:
+		allowed, _, ok := h.cache.getStale(key)
+		return ok && allowed
+	}
 
-	if v, ok := h.clientBlockMap[client]; ok {
-		if time.Now().Before(v) {
-			return true
+	return false
+}
+
+// initBreakers gives every endpoint pool its own circuit breaker, so an outage of one check type does not
+// trip the failure policy for the others
+func (h *HTTPAuthHook) initBreakers(config CircuitBreakerConfig) {
+	pools := map[string]*endpointPool{
+		"acl":           h.aclhosts,
+		"client_auth":   h.clientauthhosts,
+		"superuser":     h.superuserhosts,
+		"enhanced_auth": h.enhancedauthhosts,
+		"acl_batch":     h.batchhosts,
+	}
+	for check, pool := range pools {
+		if pool != nil {
+			pool.breaker = newCircuitBreaker(config, h.logStateChange(check))
+		}
+	}
+}
+
+func (h *HTTPAuthHook) logStateChange(check string) func(from, to circuitState) {
+	return func(from, to circuitState) {
+		h.Log.Warn().Str("hook", h.ID()).Str("check", check).Str("from", from.String()).Str("to", to.String()).Msg("http auth circuit breaker state changed")
+	}
+}
+
+// checkIfClientBlocked reports whether any of the block keys of the client is blocked
+func (h *HTTPAuthHook) checkIfClientBlocked(cl *mqtt.Client) bool {
+	// Exit early if timeout was not configured and thusly no block store has been set up
+	if h.blocks == nil {
+		return false
+	}
+
+	for _, bk := range h.timeout.BlockKeys {
+		key := bk.key(cl)
+		if key == "" {
+			continue
+		}
+
+		until, ok, err := h.blocks.BlockedUntil(key)
+		if err != nil {
+			// an unreachable store should not lock every client out
+			h.Log.Error().Err(err).Str("key", key).Msg("failed to check client block")
+			continue
+		}
+
+		if ok {
+			if time.Now().Before(until) {
+				return true
+			}
+			if err := h.blocks.Unblock(key); err != nil {
+				h.Log.Error().Err(err).Str("key", key).Msg("failed to remove expired client block")
+			}
 		}
-		delete(h.clientBlockMap, client)
 	}
 
 	return false
 }
 
-func (h *HTTPAuthHook) blockClient(client string) {
-	// Exit early if timeout was not configured and thusly client block map has not been created
-	if (h.timeout == TimeoutConfig{}) {
+// blockClient records a rejection against each block key of the client, blocking the keys that reach the
+// failure threshold. Each block of a key lasts longer than the last until the key has behaved for EscalationReset
+func (h *HTTPAuthHook) blockClient(cl *mqtt.Client) {
+	// Exit early if timeout was not configured and thusly no block store has been set up
+	if h.blocks == nil {
 		return
 	}
 
-	h.timeoutLock.Lock()
-	defer h.timeoutLock.Unlock()
+	for _, bk := range h.timeout.BlockKeys {
+		key := bk.key(cl)
+		if key == "" {
+			continue
+		}
 
-	h.clientBlockMap[client] = time.Now().Add(h.timeout.TimeoutDuration)
+		if err := h.blockKey(key); err != nil {
+			h.Log.Error().Err(err).Str("key", key).Msg("failed to block client")
+		}
+	}
+}
+
+func (h *HTTPAuthHook) blockKey(key string) error {
+	failures, err := h.blocks.Increment("fail:"+key, h.timeout.FailureWindow)
+	if err != nil || failures < int64(h.timeout.FailureThreshold) {
+		return err
+	}
+
+	offenses, err := h.blocks.Increment("offense:"+key, h.timeout.EscalationReset)
+	if err != nil {
+		return err
+	}
+
+	if err := h.blocks.Block(key, time.Now().Add(h.timeout.blockDuration(offenses))); err != nil {
+		return err
+	}
+
+	// the client gets the full threshold again once the block has passed
+	return h.blocks.ResetCount("fail:" + key)
 }
 
 func validateConfig(config HTTPAuthHookConfig) bool {
-	if config.ACLHost == "" || config.ClientAuthenticationHost == "" {
+	if config.ACLHost == "" && len(config.ACLHosts) == 0 {
+		return false
+	}
+	if config.ClientAuthenticationHost == "" && len(config.ClientAuthenticationHosts) == 0 {
 		return false
 	}
 	return true
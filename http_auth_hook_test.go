@@ -2,8 +2,11 @@ package mochicloudhooks
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,6 +43,16 @@ func TestProvides(t *testing.T) {
 			hook:           mqtt.OnConnectAuthenticate,
 			expectProvides: true,
 		},
+		{
+			name:           "Success - Provides OnDisconnect",
+			hook:           mqtt.OnDisconnect,
+			expectProvides: true,
+		},
+		{
+			name:           "Success - Provides OnPacketEncode",
+			hook:           mqtt.OnPacketEncode,
+			expectProvides: true,
+		},
 		{
 			name:           "Failure - Provides other hook",
 			hook:           mqtt.OnClientExpired,
@@ -85,6 +98,14 @@ func TestInit(t *testing.T) {
 			config:      HTTPAuthHookConfig{},
 			expectError: true,
 		},
+		{
+			name: "Success - Endpoint lists",
+			config: HTTPAuthHookConfig{
+				ACLHosts:                  []Endpoint{{URL: "http://aclhost.com"}},
+				ClientAuthenticationHosts: []Endpoint{{URL: "http://clientauthenticationhost.com"}},
+			},
+			expectError: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -155,7 +176,7 @@ func TestOnACLCheck(t *testing.T) {
 				},
 			},
 			clientBlockMap: map[string]time.Time{
-				defaultClientID: time.Now().Add(1 * time.Minute),
+				"clientid:" + defaultClientID: time.Now().Add(1 * time.Minute),
 			},
 			expectPass: false,
 			mocks: func(ctx context.Context) {
@@ -190,7 +211,7 @@ func TestOnACLCheck(t *testing.T) {
 				},
 			},
 			clientBlockMap: map[string]time.Time{
-				defaultClientID: time.Now().Add(-1 * time.Hour),
+				"clientid:" + defaultClientID: time.Now().Add(-1 * time.Hour),
 			},
 			expectPass: true,
 			mocks: func(ctx context.Context) {
@@ -200,6 +221,26 @@ func TestOnACLCheck(t *testing.T) {
 
 			},
 		},
+		{
+			name: "Success - Proper config - Retry Configured - Recovers",
+			config: HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHost:                  "http://aclhost.com",
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+				Retry: RetryConfig{
+					MaxAttempts: 2,
+				},
+			},
+			expectPass: true,
+			mocks: func(ctx context.Context) {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+					StatusCode: http.StatusServiceUnavailable,
+				}, nil)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+					StatusCode: http.StatusOK,
+				}, nil)
+			},
+		},
 		{
 			name: "Error - HTTP error",
 			config: HTTPAuthHookConfig{
@@ -237,8 +278,8 @@ func TestOnACLCheck(t *testing.T) {
 			authHook.Log = &zerolog.Logger{}
 			authHook.Init(tt.config)
 
-			if tt.clientBlockMap != nil {
-				authHook.clientBlockMap = tt.clientBlockMap
+			for client, until := range tt.clientBlockMap {
+				authHook.blocks.Block(client, until)
 			}
 
 			success := authHook.OnACLCheck(&mqtt.Client{
@@ -306,7 +347,7 @@ func TestOnConnectAuthenticate(t *testing.T) {
 				},
 			},
 			clientBlockMap: map[string]time.Time{
-				defaultClientID: time.Now().Add(1 * time.Minute),
+				"clientid:" + defaultClientID: time.Now().Add(1 * time.Minute),
 			},
 			expectPass: false,
 			mocks: func(ctx context.Context) {
@@ -388,8 +429,8 @@ func TestOnConnectAuthenticate(t *testing.T) {
 			authHook.Log = &zerolog.Logger{}
 			authHook.Init(tt.config)
 
-			if tt.clientBlockMap != nil {
-				authHook.clientBlockMap = tt.clientBlockMap
+			for client, until := range tt.clientBlockMap {
+				authHook.blocks.Block(client, until)
 			}
 
 			success := authHook.OnConnectAuthenticate(&mqtt.Client{
@@ -399,3 +440,567 @@ func TestOnConnectAuthenticate(t *testing.T) {
 		})
 	}
 }
+
+func TestOnACLCheckSuperuser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	config := HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		SuperUserHost:            "http://superuserhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+	}
+
+	respondByHost := func(superuserStatus, aclStatus int) func(r *http.Request) (*http.Response, error) {
+		return func(r *http.Request) (*http.Response, error) {
+			if r.URL.Host == "superuserhost.com" {
+				return &http.Response{StatusCode: superuserStatus}, nil
+			}
+			return &http.Response{StatusCode: aclStatus}, nil
+		}
+	}
+
+	tests := []struct {
+		name       string
+		mocks      func()
+		expectPass bool
+	}{
+		{
+			name: "Success - Superuser skips ACL endpoint",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(respondByHost(http.StatusOK, http.StatusTeapot)).Times(1)
+			},
+			expectPass: true,
+		},
+		{
+			name: "Success - Non superuser checks ACL endpoint",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(respondByHost(http.StatusForbidden, http.StatusOK)).Times(3)
+			},
+			expectPass: true,
+		},
+		{
+			name: "Error - Superuser HTTP error falls through to ACL endpoint",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap")).Times(1)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(respondByHost(http.StatusForbidden, http.StatusTeapot)).Times(3)
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mocks()
+
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(config))
+
+			client := &mqtt.Client{ID: defaultClientID}
+
+			// the superuser endpoint is only consulted once per session
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(client, "/topic", false))
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(client, "/topic", true))
+		})
+	}
+}
+
+func TestOnDisconnectClearsSuperuser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		SuperUserHost:            "http://superuserhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+	}))
+
+	client := &mqtt.Client{ID: defaultClientID}
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(2)
+
+	require.True(t, authHook.OnACLCheck(client, "/topic", false))
+	require.True(t, authHook.OnACLCheck(client, "/topic", false))
+
+	authHook.OnDisconnect(client, nil, false)
+	require.True(t, authHook.OnACLCheck(client, "/topic", false))
+}
+
+func TestSuperuserSessionTakeover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		SuperUserHost:            "http://superuserhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+	}))
+
+	admin := &mqtt.Client{ID: defaultClientID}
+	admin.Properties.Username = []byte("admin")
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(1)
+	require.True(t, authHook.OnACLCheck(admin, "$admin/secret", true))
+
+	// a client taking over the session with another username is not given the old client's superuser status
+	nobody := &mqtt.Client{ID: defaultClientID}
+	nobody.Properties.Username = []byte("nobody")
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusForbidden}, nil).Times(3)
+	require.False(t, authHook.OnACLCheck(nobody, "$admin/secret", false))
+
+	// the old client disconnecting does not clear the new client's status
+	authHook.OnDisconnect(admin, nil, false)
+	require.False(t, authHook.OnACLCheck(nobody, "$admin/secret", false))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		RequestTimeout: RequestTimeoutConfig{
+			ClientAuthentication: 10 * time.Millisecond,
+			ACL:                  10 * time.Millisecond,
+		},
+	}))
+
+	hang := func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(hang).Times(2)
+
+	client := &mqtt.Client{ID: defaultClientID}
+	require.False(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+	require.False(t, authHook.OnACLCheck(client, "/topic", false))
+}
+
+func TestInFlightRequestsCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name   string
+		cancel func(h *HTTPAuthHook, cl *mqtt.Client)
+	}{
+		{
+			name: "Success - Cancelled on disconnect",
+			cancel: func(h *HTTPAuthHook, cl *mqtt.Client) {
+				h.OnDisconnect(cl, nil, false)
+			},
+		},
+		{
+			name: "Success - Cancelled on stop",
+			cancel: func(h *HTTPAuthHook, cl *mqtt.Client) {
+				require.NoError(t, h.Stop())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHost:                  "http://aclhost.com",
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+			}))
+
+			started := make(chan struct{})
+			mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+				close(started)
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}).Times(1)
+
+			client := &mqtt.Client{ID: defaultClientID}
+			result := make(chan bool)
+			go func() {
+				result <- authHook.OnACLCheck(client, "/topic", false)
+			}()
+
+			<-started
+			tt.cancel(authHook, client)
+
+			select {
+			case pass := <-result:
+				require.False(t, pass)
+			case <-time.After(time.Second):
+				require.Fail(t, "in-flight request was not cancelled")
+			}
+		})
+	}
+}
+
+func TestResponseModeJSON(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	respond := func(code int, body string) *http.Response {
+		return &http.Response{StatusCode: code, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	tests := []struct {
+		name       string
+		mocks      func()
+		expectPass bool
+	}{
+		{
+			name: "Success - Allow result",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK, `{"result":"allow"}`), nil)
+			},
+			expectPass: true,
+		},
+		{
+			name: "Failure - Deny result",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK, `{"result":"deny"}`), nil)
+			},
+			expectPass: false,
+		},
+		{
+			name: "Failure - Malformed body",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK, `allow`), nil)
+			},
+			expectPass: false,
+		},
+		{
+			name: "Failure - Non 2xx with allow result",
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusTeapot, `{"result":"allow"}`), nil)
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mocks()
+
+			authHook := new(HTTPAuthHook)
+			authHook.Log = &zerolog.Logger{}
+			require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+				RoundTripper:             mockRT,
+				ACLHost:                  "http://aclhost.com",
+				ClientAuthenticationHost: "http://clientauthenticationhost.com",
+				ResponseMode:             ResponseModeJSON,
+			}))
+
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+		})
+	}
+}
+
+func TestResponseModeJSONConnectGrants(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	newHook := func() *HTTPAuthHook {
+		authHook := new(HTTPAuthHook)
+		authHook.Log = &zerolog.Logger{}
+		require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+			RoundTripper:             mockRT,
+			ACLHost:                  "http://aclhost.com",
+			SuperUserHost:            "http://superuserhost.com",
+			ClientAuthenticationHost: "http://clientauthenticationhost.com",
+			ResponseMode:             ResponseModeJSON,
+			Cache: CacheConfig{
+				Size:        10,
+				PositiveTTL: time.Millisecond,
+			},
+		}))
+		return authHook
+	}
+
+	t.Run("Success - ACL filters granted at connect are checked locally", func(t *testing.T) {
+		authHook := newHook()
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"allow","acl":["devices/+/telemetry","commands/#"]}`)),
+		}, nil)
+		require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+
+		require.True(t, authHook.OnACLCheck(client, "devices/1/telemetry", true))
+		require.True(t, authHook.OnACLCheck(client, "commands/1/reboot", false))
+
+		// topics outside the granted filters still go to the endpoints
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"deny"}`)),
+		}, nil).Times(2)
+		require.False(t, authHook.OnACLCheck(client, "other", true))
+
+		// grants are dropped on disconnect
+		authHook.OnDisconnect(client, nil, false)
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"deny"}`)),
+		}, nil).Times(2)
+		require.False(t, authHook.OnACLCheck(client, "commands/1/reboot", false))
+	})
+
+	t.Run("Success - Superuser granted at connect", func(t *testing.T) {
+		authHook := newHook()
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"allow","superuser":true}`)),
+		}, nil)
+		require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+		require.True(t, authHook.OnACLCheck(client, "any/topic", true))
+	})
+
+	t.Run("Success - Connect served from the cache is granted the cached filters", func(t *testing.T) {
+		authHook := newHook()
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"allow","acl":["commands/#"],"ttl":60}`)),
+		}, nil)
+		require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+
+		// a session takeover with the same credentials is served from the cache
+		takeover := &mqtt.Client{ID: defaultClientID}
+		require.True(t, authHook.OnConnectAuthenticate(takeover, packets.Packet{}))
+		require.True(t, authHook.OnACLCheck(takeover, "commands/1/reboot", false))
+
+		// the old client disconnecting leaves the new client's grants in place
+		authHook.OnDisconnect(client, nil, false)
+		require.True(t, authHook.OnACLCheck(takeover, "commands/1/reboot", false))
+	})
+
+	t.Run("Success - Grants are not shared by clients with the same id", func(t *testing.T) {
+		authHook := newHook()
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"allow","acl":["commands/#"]}`)),
+		}, nil)
+		require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+
+		other := &mqtt.Client{ID: defaultClientID}
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"deny"}`)),
+		}, nil).Times(2)
+		require.False(t, authHook.OnACLCheck(other, "commands/1/reboot", false))
+	})
+
+	t.Run("Success - Superuser granted at connect without a superuser endpoint", func(t *testing.T) {
+		authHook := new(HTTPAuthHook)
+		authHook.Log = &zerolog.Logger{}
+		require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+			RoundTripper:             mockRT,
+			ACLHost:                  "http://aclhost.com",
+			ClientAuthenticationHost: "http://clientauthenticationhost.com",
+			ResponseMode:             ResponseModeJSON,
+		}))
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"result":"allow","superuser":true}`)),
+		}, nil)
+		require.True(t, authHook.OnConnectAuthenticate(client, packets.Packet{}))
+		require.True(t, authHook.OnACLCheck(client, "any/topic", true))
+	})
+
+	t.Run("Success - TTL hint overrides configured TTL", func(t *testing.T) {
+		authHook := newHook()
+		client := &mqtt.Client{ID: defaultClientID}
+
+		mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Host == "superuserhost.com" {
+				return &http.Response{StatusCode: http.StatusForbidden, Body: http.NoBody}, nil
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"result":"allow","ttl":60}`)),
+			}, nil
+		}).Times(2)
+
+		require.True(t, authHook.OnACLCheck(client, "topic", true))
+		time.Sleep(5 * time.Millisecond)
+		require.True(t, authHook.OnACLCheck(client, "topic", true))
+	})
+}
+
+func TestOutboundCredentials(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Headers:                  map[string]string{"X-Api-Key": "key"},
+		TokenSource:              StaticTokenSource("token"),
+	}))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, "key", r.Header.Get("X-Api-Key"))
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+}
+
+func TestBruteForceBlocking(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			BlockKeys:        []BlockKey{BlockByUsername | BlockByRemoteIP},
+			FailureThreshold: 2,
+			Escalation:       []time.Duration{time.Minute, 10 * time.Minute},
+		},
+	}))
+	defer authHook.Stop()
+
+	newClient := func(id string) *mqtt.Client {
+		cl := &mqtt.Client{ID: id}
+		cl.Properties.Username = []byte("user")
+		cl.Net.Remote = "10.0.0.1:5000"
+		return cl
+	}
+	key := "username:user|ip:10.0.0.1"
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody}, nil
+	}).Times(4)
+
+	// the first rejection is below the threshold, rotating the client id does not avoid the second
+	require.False(t, authHook.OnConnectAuthenticate(newClient("a"), packets.Packet{}))
+	require.False(t, authHook.checkIfClientBlocked(newClient("b")))
+	require.False(t, authHook.OnConnectAuthenticate(newClient("b"), packets.Packet{}))
+	require.True(t, authHook.checkIfClientBlocked(newClient("c")))
+
+	until, ok, err := authHook.blocks.BlockedUntil(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(time.Minute), until, time.Second)
+
+	// blocked clients are rejected without a request
+	require.False(t, authHook.OnConnectAuthenticate(newClient("c"), packets.Packet{}))
+
+	// a repeat offense once the block has passed is blocked for longer
+	require.NoError(t, authHook.blocks.Block(key, time.Now().Add(-time.Second)))
+	require.False(t, authHook.OnConnectAuthenticate(newClient("d"), packets.Packet{}))
+	require.False(t, authHook.OnConnectAuthenticate(newClient("e"), packets.Packet{}))
+
+	until, ok, err = authHook.blocks.BlockedUntil(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), until, time.Second)
+
+	// the same client id from another address is not affected
+	other := newClient("c")
+	other.Net.Remote = "10.0.0.2:5000"
+	require.False(t, authHook.checkIfClientBlocked(other))
+}
+
+func TestACLAccess(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+	}))
+	defer authHook.Stop()
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		var payload ACLCheckPOST
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+
+		switch payload.Topic {
+		case "devices/+/telemetry":
+			require.Equal(t, ACLAccessSubscribe, payload.ACC)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		case "devices/1/telemetry":
+			require.Equal(t, ACLAccessWrite, payload.ACC)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusForbidden, Body: http.NoBody}, nil
+	}).Times(4)
+
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	// each filter of a subscribe gets its own result, and a denied filter does not block the client
+	require.False(t, authHook.OnACLCheck(cl, "#", false))
+	require.True(t, authHook.OnACLCheck(cl, "devices/+/telemetry", false))
+	require.True(t, authHook.OnACLCheck(cl, "devices/1/telemetry", true))
+
+	// a denied publish still blocks
+	require.False(t, authHook.OnACLCheck(cl, "admin", true))
+	require.True(t, authHook.checkIfClientBlocked(cl))
+}
+
+func TestACLAccessSubscribeAsRead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		SubscribeAccess:          ACLAccessRead,
+	}))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"clientid": "default_client_id", "username": "", "topic": "/topic", "acc": 1}`, string(body))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+}
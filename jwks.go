@@ -0,0 +1,237 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwk is a single key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwksKey is a parsed verification key
+type jwksKey struct {
+	alg string // empty when the key does not restrict the algorithm
+	key crypto.PublicKey
+}
+
+// jwksCache holds the keys of a JWKS URL, refreshing them periodically and when a token names an unknown key.
+// The last keys fetched successfully are kept when a refresh fails
+type jwksCache struct {
+	url                string
+	client             *http.Client
+	minRefreshInterval time.Duration
+	mu                 sync.RWMutex
+	keys               map[string]jwksKey
+	fetched            time.Time
+	refreshLock        sync.Mutex
+	done               chan struct{}
+	once               sync.Once
+}
+
+func newJWKSCache(url string, client *http.Client, minRefreshInterval time.Duration) *jwksCache {
+	return &jwksCache{
+		url:                url,
+		client:             client,
+		minRefreshInterval: minRefreshInterval,
+		keys:               make(map[string]jwksKey),
+		done:               make(chan struct{}),
+	}
+}
+
+// start refreshes the keys every interval until close is called
+func (c *jwksCache) start(interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := c.refresh(); err != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *jwksCache) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// key returns the key with the given id, refreshing the keys once if it is unknown and the keys have not
+// been refreshed within minRefreshInterval
+func (c *jwksCache) key(kid string) (jwksKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	fetched := c.fetched
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(fetched) < c.minRefreshInterval {
+		return jwksKey{}, fmt.Errorf("unknown key id %q", kid)
+	}
+	if err := c.refresh(); err != nil {
+		return jwksKey{}, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return jwksKey{}, fmt.Errorf("unknown key id %q", kid)
+}
+
+// refresh fetches the keys and swaps them in, keeping the current keys on error
+func (c *jwksCache) refresh() error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks request returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBodySize)).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	keys := make(map[string]jwksKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			// a single unsupported key should not take down the others
+			continue
+		}
+		keys[k.Kid] = jwksKey{alg: k.Alg, key: pub}
+	}
+	if len(keys) == 0 {
+		return errors.New("jwks contains no usable keys")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keys
+	c.fetched = time.Now()
+
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,236 @@
+package mochicloudhooks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtClaims are the decoded claims of a verified token
+type jwtClaims map[string]any
+
+// jwtAlgorithm describes how a JWS algorithm is verified
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	kind string // "rsa", "rsa-pss", "ecdsa" or "eddsa"
+}
+
+// jwtAlgorithms are the supported asymmetric algorithms. Symmetric algorithms and "none" are never accepted
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {crypto.SHA256, "rsa"},
+	"RS384": {crypto.SHA384, "rsa"},
+	"RS512": {crypto.SHA512, "rsa"},
+	"PS256": {crypto.SHA256, "rsa-pss"},
+	"PS384": {crypto.SHA384, "rsa-pss"},
+	"PS512": {crypto.SHA512, "rsa-pss"},
+	"ES256": {crypto.SHA256, "ecdsa"},
+	"ES384": {crypto.SHA384, "ecdsa"},
+	"ES512": {crypto.SHA512, "ecdsa"},
+	"EdDSA": {0, "eddsa"},
+}
+
+// jwtCurves are the curves the ECDSA algorithms are defined for, e.g. ES256 is only valid with P-256
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// verifyJWT checks the signature of a compact serialized token against the key named in its header
+// and returns its claims. The claims themselves are not validated
+func verifyJWT(token string, keys *jwksCache) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("key %q does not allow algorithm %q", header.Kid, header.Alg)
+	}
+	if pub, ok := key.key.(*ecdsa.PublicKey); ok && pub.Curve != jwtCurves[header.Alg] {
+		return nil, fmt.Errorf("key %q does not allow algorithm %q", header.Kid, header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	if err := alg.verify(key.key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	return claims, nil
+}
+
+func (a jwtAlgorithm) verify(key crypto.PublicKey, signed, sig []byte) error {
+	errInvalid := errors.New("invalid token signature")
+
+	var digest []byte
+	if a.hash != 0 {
+		h := a.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	switch a.kind {
+	case "rsa", "rsa-pss":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errInvalid
+		}
+		if a.kind == "rsa-pss" {
+			if rsa.VerifyPSS(pub, a.hash, digest, sig, nil) != nil {
+				return errInvalid
+			}
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(pub, a.hash, digest, sig) != nil {
+			return errInvalid
+		}
+		return nil
+
+	case "ecdsa":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errInvalid
+		}
+		// JWS ECDSA signatures are the fixed size concatenation of r and s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errInvalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errInvalid
+		}
+		return nil
+
+	case "eddsa":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return errInvalid
+		}
+		return nil
+	}
+
+	return errInvalid
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// numericDate returns the numeric date claim name as a time, and whether the claim is present
+func (c jwtClaims) numericDate(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true, nil
+}
+
+// lookup returns the claim at a dot separated path, e.g. "mqtt.publish"
+func (c jwtClaims) lookup(path string) (any, bool) {
+	var v any = map[string]any(c)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// audience returns the aud claim, which is either a single audience or a list of them. Unlike other
+// string claims a single audience is never split on spaces
+func (c jwtClaims) audience() []string {
+	if aud, ok := c["aud"].(string); ok {
+		return []string{aud}
+	}
+	return c.stringList("aud")
+}
+
+// stringList returns the claim at path as a list of strings. A single string claim is split on spaces,
+// as with the OAuth2 scope claim
+func (c jwtClaims) stringList(path string) []string {
+	v, ok := c.lookup(path)
+	if !ok {
+		return nil
+	}
+
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// stringClaim returns the claim at path if it is a string
+func (c jwtClaims) stringClaim(path string) string {
+	v, _ := c.lookup(path)
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,213 @@
+package mochicloudhooks
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// JWTAuthHook authenticates clients presenting a JWT as their password, verifying it locally against
+// the keys of a JWKS URL. The topic filters a client may use are taken from the token's claims, so ACL
+// checks are answered without a request
+type JWTAuthHook struct {
+	config JWTAuthHookConfig
+	keys   *jwksCache
+	mu     sync.Mutex
+	grants map[*mqtt.Client]jwtGrant
+	mqtt.HookBase
+}
+
+type JWTAuthHookConfig struct {
+	JWKSURL            string
+	RoundTripper       http.RoundTripper // used to fetch the JWKS, defaults to http.DefaultTransport
+	RefreshInterval    time.Duration     // how often the JWKS is fetched again, defaults to 1 hour
+	MinRefreshInterval time.Duration     // least time between fetches caused by unknown key ids, defaults to 1 minute
+	Issuer             string            // required iss claim, not checked when empty
+	Audience           string            // required aud claim, not checked when empty
+	Leeway             time.Duration     // clock skew allowed when checking exp and nbf
+	UsernameClaim      string            // claim that must equal the connect username, not checked when empty
+	PublishClaim       string            // claim listing topic filters the client may publish to, defaults to "publish"
+	SubscribeClaim     string            // claim listing topic filters the client may subscribe to, defaults to "subscribe"
+	ACLClaim           string            // claim listing topic filters the client may publish and subscribe to, defaults to "acl"
+}
+
+// jwtGrant is what a verified token allows for the rest of the session
+type jwtGrant struct {
+	expires   time.Time
+	publish   []string
+	subscribe []string
+}
+
+func (h *JWTAuthHook) ID() string {
+	return "jwt-auth-hook"
+}
+
+func (h *JWTAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+func (h *JWTAuthHook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	jwtConfig, ok := config.(JWTAuthHookConfig)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if jwtConfig.JWKSURL == "" {
+		return errors.New("jwks url is required")
+	}
+	if jwtConfig.RefreshInterval <= 0 {
+		jwtConfig.RefreshInterval = time.Hour
+	}
+	if jwtConfig.MinRefreshInterval <= 0 {
+		jwtConfig.MinRefreshInterval = time.Minute
+	}
+	if jwtConfig.PublishClaim == "" {
+		jwtConfig.PublishClaim = "publish"
+	}
+	if jwtConfig.SubscribeClaim == "" {
+		jwtConfig.SubscribeClaim = "subscribe"
+	}
+	if jwtConfig.ACLClaim == "" {
+		jwtConfig.ACLClaim = "acl"
+	}
+
+	rt := jwtConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.config = jwtConfig
+	h.grants = make(map[*mqtt.Client]jwtGrant)
+	h.keys = newJWKSCache(jwtConfig.JWKSURL, &http.Client{Transport: rt}, jwtConfig.MinRefreshInterval)
+	if err := h.keys.refresh(); err != nil {
+		return err
+	}
+	h.keys.start(jwtConfig.RefreshInterval, func(err error) {
+		h.Log.Error().Err(err).Str("hook", h.ID()).Msg("failed to refresh jwks, keeping previous keys")
+	})
+
+	return nil
+}
+
+// Stop stops refreshing the JWKS
+func (h *JWTAuthHook) Stop() error {
+	if h.keys != nil {
+		h.keys.close()
+	}
+	return nil
+}
+
+func (h *JWTAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	grant, err := h.authenticate(string(pk.Connect.Username), string(pk.Connect.Password))
+	if err != nil {
+		h.Log.Debug().Err(err).Str("client", cl.ID).Msg("jwt authentication failed")
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.grants[cl] = grant
+
+	return true
+}
+
+func (h *JWTAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.Lock()
+	grant, ok := h.grants[cl]
+	h.mu.Unlock()
+
+	// the token only covers the session until it expires
+	if !ok || !time.Now().Before(grant.expires.Add(h.config.Leeway)) {
+		return false
+	}
+
+	filters := grant.subscribe
+	if write {
+		filters = grant.publish
+	}
+	for _, filter := range filters {
+		if matchTopicFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OnDisconnect drops the grant of the client
+func (h *JWTAuthHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.grants, cl)
+}
+
+// authenticate verifies a token and its claims and returns what it grants
+func (h *JWTAuthHook) authenticate(username, token string) (jwtGrant, error) {
+	claims, err := verifyJWT(token, h.keys)
+	if err != nil {
+		return jwtGrant{}, err
+	}
+
+	now := time.Now()
+	expires, ok, err := claims.numericDate("exp")
+	if err != nil {
+		return jwtGrant{}, err
+	}
+	if !ok {
+		return jwtGrant{}, errors.New("token has no expiry")
+	}
+	if !now.Before(expires.Add(h.config.Leeway)) {
+		return jwtGrant{}, errors.New("token has expired")
+	}
+
+	notBefore, ok, err := claims.numericDate("nbf")
+	if err != nil {
+		return jwtGrant{}, err
+	}
+	if ok && now.Add(h.config.Leeway).Before(notBefore) {
+		return jwtGrant{}, errors.New("token is not valid yet")
+	}
+
+	if h.config.Issuer != "" && claims.stringClaim("iss") != h.config.Issuer {
+		return jwtGrant{}, errors.New("token has the wrong issuer")
+	}
+
+	// aud may be a single string or a list
+	if h.config.Audience != "" && !containsString(claims.audience(), h.config.Audience) {
+		return jwtGrant{}, errors.New("token has the wrong audience")
+	}
+
+	if h.config.UsernameClaim != "" && claims.stringClaim(h.config.UsernameClaim) != username {
+		return jwtGrant{}, errors.New("token does not belong to the username")
+	}
+
+	acl := claims.stringList(h.config.ACLClaim)
+	return jwtGrant{
+		expires:   expires,
+		publish:   append(claims.stringList(h.config.PublishClaim), acl...),
+		subscribe: append(claims.stringList(h.config.SubscribeClaim), acl...),
+	}, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,340 @@
+package mochicloudhooks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// testJWKS serves the public keys added to it as a JWKS
+type testJWKS struct {
+	mu       sync.Mutex
+	keys     []map[string]string
+	requests int32
+	server   *httptest.Server
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	j := &testJWKS{}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&j.requests, 1)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": j.keys})
+	}))
+	t.Cleanup(j.server.Close)
+	return j
+}
+
+func (j *testJWKS) addRSA(kid string, key *rsa.PublicKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = append(j.keys, map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	})
+}
+
+func (j *testJWKS) addEC(kid string, key *ecdsa.PublicKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = append(j.keys, map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+}
+
+func signTestJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := jwtAlgorithms[alg].hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest)
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtConnect(username, token string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(token),
+		},
+	}
+}
+
+func TestJWTAuthHook(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := newTestJWKS(t)
+	jwks.addRSA("rsa", &rsaKey.PublicKey)
+	jwks.addEC("ec", &ecKey.PublicKey)
+
+	authHook := new(JWTAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(JWTAuthHookConfig{
+		JWKSURL:       jwks.server.URL,
+		Issuer:        "https://issuer.example.com",
+		Audience:      "mqtt",
+		UsernameClaim: "sub",
+		PublishClaim:  "mqtt.publish",
+	}))
+	defer authHook.Stop()
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":       "https://issuer.example.com",
+			"aud":       []string{"mqtt", "api"},
+			"sub":       "device",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+			"mqtt":      map[string]any{"publish": []string{"devices/device/+"}},
+			"subscribe": "commands/device commands/all",
+		}
+	}
+
+	tests := []struct {
+		name       string
+		username   string
+		token      func() string
+		expectPass bool
+	}{
+		{
+			name:       "Success - RSA",
+			username:   "device",
+			token:      func() string { return signTestJWT(t, rsaKey, "RS256", "rsa", valid()) },
+			expectPass: true,
+		},
+		{
+			name:       "Success - ECDSA",
+			username:   "device",
+			token:      func() string { return signTestJWT(t, ecKey, "ES256", "ec", valid()) },
+			expectPass: true,
+		},
+		{
+			name:     "Error - Wrong Key",
+			username: "device",
+			token:    func() string { return signTestJWT(t, rsaKey, "RS256", "ec", valid()) },
+		},
+		{
+			name:     "Error - ECDSA Wrong Curve",
+			username: "device",
+			token:    func() string { return signTestJWT(t, ecKey, "ES384", "ec", valid()) },
+		},
+		{
+			name:     "Error - Unsigned",
+			username: "device",
+			token: func() string {
+				token := signTestJWT(t, rsaKey, "RS256", "rsa", valid())
+				header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+				return header + token[len(header):]
+			},
+		},
+		{
+			name:     "Error - Expired",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				claims["exp"] = time.Now().Add(-time.Minute).Unix()
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - Not Yet Valid",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				claims["nbf"] = time.Now().Add(time.Minute).Unix()
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - No Expiry",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				delete(claims, "exp")
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - Wrong Issuer",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				claims["iss"] = "https://other.example.com"
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - Wrong Audience",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				claims["aud"] = "api"
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - Audience Not Split",
+			username: "device",
+			token: func() string {
+				claims := valid()
+				claims["aud"] = "other mqtt"
+				return signTestJWT(t, rsaKey, "RS256", "rsa", claims)
+			},
+		},
+		{
+			name:     "Error - Wrong Username",
+			username: "other",
+			token:    func() string { return signTestJWT(t, rsaKey, "RS256", "rsa", valid()) },
+		},
+		{
+			name:     "Error - Malformed",
+			username: "device",
+			token:    func() string { return "not-a-token" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := &mqtt.Client{ID: defaultClientID}
+			require.Equal(t, tt.expectPass, authHook.OnConnectAuthenticate(cl, jwtConnect(tt.username, tt.token())))
+		})
+	}
+}
+
+func TestJWTAuthHookACL(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks := newTestJWKS(t)
+	jwks.addRSA("rsa", &rsaKey.PublicKey)
+
+	authHook := new(JWTAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(JWTAuthHookConfig{
+		JWKSURL: jwks.server.URL,
+	}))
+	defer authHook.Stop()
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	require.False(t, authHook.OnACLCheck(cl, "devices/device/telemetry", true))
+
+	token := signTestJWT(t, rsaKey, "RS256", "rsa", map[string]any{
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"publish":   []string{"devices/device/+"},
+		"subscribe": []string{"commands/device"},
+		"acl":       []string{"shared/#"},
+	})
+	require.True(t, authHook.OnConnectAuthenticate(cl, jwtConnect("", token)))
+
+	require.True(t, authHook.OnACLCheck(cl, "devices/device/telemetry", true))
+	require.False(t, authHook.OnACLCheck(cl, "devices/device/telemetry", false))
+	require.True(t, authHook.OnACLCheck(cl, "commands/device", false))
+	require.False(t, authHook.OnACLCheck(cl, "commands/device", true))
+	require.True(t, authHook.OnACLCheck(cl, "shared/a/b", true))
+	require.True(t, authHook.OnACLCheck(cl, "shared/a/b", false))
+	require.False(t, authHook.OnACLCheck(cl, "devices/other/telemetry", true))
+
+	// the grant ends with the token
+	authHook.mu.Lock()
+	grant := authHook.grants[cl]
+	grant.expires = time.Now().Add(-time.Second)
+	authHook.grants[cl] = grant
+	authHook.mu.Unlock()
+	require.False(t, authHook.OnACLCheck(cl, "devices/device/telemetry", true))
+
+	authHook.OnDisconnect(cl, nil, false)
+	authHook.mu.Lock()
+	require.Empty(t, authHook.grants)
+	authHook.mu.Unlock()
+}
+
+func TestJWTAuthHookKeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks := newTestJWKS(t)
+	jwks.addRSA("old", &oldKey.PublicKey)
+
+	authHook := new(JWTAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(JWTAuthHookConfig{
+		JWKSURL:            jwks.server.URL,
+		MinRefreshInterval: time.Millisecond,
+	}))
+	defer authHook.Stop()
+	require.Equal(t, int32(1), atomic.LoadInt32(&jwks.requests))
+
+	claims := map[string]any{"exp": time.Now().Add(time.Hour).Unix()}
+	token := signTestJWT(t, newKey, "RS256", "new", claims)
+
+	// an unknown key id is denied until the key is published
+	time.Sleep(2 * time.Millisecond)
+	require.False(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "a"}, jwtConnect("", token)))
+	require.Equal(t, int32(2), atomic.LoadInt32(&jwks.requests))
+
+	jwks.addRSA("new", &newKey.PublicKey)
+	time.Sleep(2 * time.Millisecond)
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "b"}, jwtConnect("", token)))
+	require.Equal(t, int32(3), atomic.LoadInt32(&jwks.requests))
+
+	// known keys are not fetched again
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{ID: "c"}, jwtConnect("", signTestJWT(t, oldKey, "RS256", "old", claims))))
+	require.Equal(t, int32(3), atomic.LoadInt32(&jwks.requests))
+}
+
+func TestJWTAuthHookInit(t *testing.T) {
+	authHook := new(JWTAuthHook)
+	authHook.Log = &zerolog.Logger{}
+
+	require.Error(t, authHook.Init(nil))
+	require.Error(t, authHook.Init("config"))
+	require.Error(t, authHook.Init(JWTAuthHookConfig{}))
+
+	// the keys must be fetched at start up
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	require.Error(t, authHook.Init(JWTAuthHookConfig{JWKSURL: server.URL}))
+}
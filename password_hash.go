@@ -0,0 +1,138 @@
+package mochicloudhooks
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var errUnsupportedHash = errors.New("unsupported password hash format")
+
+// dummyPasswordHash is verified against when a username is unknown, so the time taken to reject a client
+// does not reveal which usernames exist
+var dummyPasswordHash passwordHash = bcryptHash("$2a$10$y7fYwZXb7t8kC5gIHwqn3.5wPuxNsix4fPEonBpcZ.U7lrV7EdT.W")
+
+// passwordHash is a parsed password hash that a password can be verified against
+type passwordHash interface {
+	verify(password []byte) bool
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password []byte) bool {
+	return bcrypt.CompareHashAndPassword(h, password) == nil
+}
+
+type argon2idHash struct {
+	salt       []byte
+	key        []byte
+	memory     uint32
+	iterations uint32
+	threads    uint8
+}
+
+func (h argon2idHash) verify(password []byte) bool {
+	derived := argon2.IDKey(password, h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(derived, h.key) == 1
+}
+
+type pbkdf2Hash struct {
+	salt       []byte
+	key        []byte
+	iterations int
+	hash       func() hash.Hash
+}
+
+func (h pbkdf2Hash) verify(password []byte) bool {
+	derived := pbkdf2.Key(password, h.salt, h.iterations, len(h.key), h.hash)
+	return subtle.ConstantTimeCompare(derived, h.key) == 1
+}
+
+// parsePasswordHash parses a password hash. Supported formats are bcrypt ($2a$, $2b$ or $2y$), argon2id
+// in PHC format ($argon2id$v=19$m=65536,t=3,p=4$salt$hash), PBKDF2 in PHC format
+// ($pbkdf2-sha256$i=310000$salt$hash or $pbkdf2-sha512$...) and the PBKDF2-SHA512 format of mosquitto
+// ($7$iterations$salt$hash)
+func parsePasswordHash(encoded string) (passwordHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 2 || parts[0] != "" {
+		return nil, errUnsupportedHash
+	}
+
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(encoded), nil
+
+	case "argon2id":
+		return parseArgon2id(parts)
+
+	case "pbkdf2-sha256":
+		return parsePBKDF2(parts, "i=", base64.RawStdEncoding, sha256.New)
+
+	case "pbkdf2-sha512":
+		return parsePBKDF2(parts, "i=", base64.RawStdEncoding, sha512.New)
+
+	case "7":
+		return parsePBKDF2(parts, "", base64.StdEncoding, sha512.New)
+	}
+
+	return nil, errUnsupportedHash
+}
+
+func parseArgon2id(parts []string) (passwordHash, error) {
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return nil, errUnsupportedHash
+	}
+
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+		return nil, errUnsupportedHash
+	}
+	if h.memory == 0 || h.iterations == 0 || h.threads == 0 {
+		return nil, errUnsupportedHash
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errUnsupportedHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errUnsupportedHash
+	}
+
+	return h, nil
+}
+
+// parsePBKDF2 parses $id$<prefix>iterations$salt$hash
+func parsePBKDF2(parts []string, prefix string, enc *base64.Encoding, hf func() hash.Hash) (passwordHash, error) {
+	if len(parts) != 5 || !strings.HasPrefix(parts[2], prefix) {
+		return nil, errUnsupportedHash
+	}
+
+	h := pbkdf2Hash{hash: hf}
+
+	var err error
+	if h.iterations, err = strconv.Atoi(strings.TrimPrefix(parts[2], prefix)); err != nil || h.iterations <= 0 {
+		return nil, errUnsupportedHash
+	}
+	if h.salt, err = enc.DecodeString(parts[3]); err != nil {
+		return nil, errUnsupportedHash
+	}
+	if h.key, err = enc.DecodeString(parts[4]); err != nil || len(h.key) == 0 {
+		return nil, errUnsupportedHash
+	}
+
+	return h, nil
+}
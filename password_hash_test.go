@@ -0,0 +1,53 @@
+package mochicloudhooks
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func testPasswordHashes(t *testing.T, password string) map[string]string {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	salt := []byte("0123456789abcdef")
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	return map[string]string{
+		"bcrypt": string(bcryptHash),
+		"argon2id": fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s", b64(salt),
+			b64(argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32))),
+		"pbkdf2-sha256": fmt.Sprintf("$pbkdf2-sha256$i=1000$%s$%s", b64(salt),
+			b64(pbkdf2.Key([]byte(password), salt, 1000, 32, sha256.New))),
+		"mosquitto": fmt.Sprintf("$7$101$%s$%s", base64.StdEncoding.EncodeToString(salt),
+			base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte(password), salt, 101, 64, sha512.New))),
+	}
+}
+
+func TestPasswordHashVerify(t *testing.T) {
+	for name, encoded := range testPasswordHashes(t, "secret") {
+		t.Run(name, func(t *testing.T) {
+			h, err := parsePasswordHash(encoded)
+			require.NoError(t, err)
+
+			require.True(t, h.verify([]byte("secret")))
+			require.False(t, h.verify([]byte("wrong")))
+			require.False(t, h.verify(nil))
+		})
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// the dummy hash must be a real bcrypt hash for it to cost as much as verifying a stored credential
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash.(bcryptHash)))
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.DefaultCost, cost)
+	require.False(t, dummyPasswordHash.verify([]byte("secret")))
+}
@@ -0,0 +1,400 @@
+package mochicloudhooks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisBlockStoreConfig configures a RedisBlockStore
+type RedisBlockStoreConfig struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string        // prepended to every key, defaults to "mochi:block:"
+	Timeout   time.Duration // dial and per command timeout, defaults to 2 seconds
+}
+
+// RedisBlockStore is a BlockStore kept in Redis, or anything speaking the Redis protocol,
+// so a client blocked on one broker is blocked on all of them. Blocks expire through Redis key TTLs
+type RedisBlockStore struct {
+	config RedisBlockStoreConfig
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisCounterPrefix separates counters from blocks under the key prefix
+const redisCounterPrefix = "count:"
+
+// errRedisNil is returned for a nil bulk reply
+var errRedisNil = errors.New("redis: nil")
+
+// NewRedisBlockStore returns a RedisBlockStore. The connection is established lazily and
+// re-established after errors
+func NewRedisBlockStore(config RedisBlockStoreConfig) *RedisBlockStore {
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "mochi:block:"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+
+	return &RedisBlockStore{
+		config: config,
+	}
+}
+
+// BlockedUntil returns when the block on key ends and whether key is blocked at all
+func (s *RedisBlockStore) BlockedUntil(key string) (time.Time, bool, error) {
+	reply, err := s.do("GET", s.config.KeyPrefix+key)
+	if errors.Is(err, errRedisNil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("redis: invalid block value %q", value)
+	}
+
+	return time.UnixMilli(ms), true, nil
+}
+
+// Block blocks key until the given time
+func (s *RedisBlockStore) Block(key string, until time.Time) error {
+	ttl := time.Until(until).Milliseconds()
+	if ttl <= 0 {
+		return s.Unblock(key)
+	}
+
+	_, err := s.do("SET", s.config.KeyPrefix+key, strconv.FormatInt(until.UnixMilli(), 10), "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// Unblock removes any block on key
+func (s *RedisBlockStore) Unblock(key string) error {
+	_, err := s.do("DEL", s.config.KeyPrefix+key)
+	return err
+}
+
+// List returns every block that has not yet expired
+func (s *RedisBlockStore) List() (map[string]time.Time, error) {
+	blocks := make(map[string]time.Time)
+
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", s.config.KeyPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		items, ok := reply.([]any)
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		cursor, _ = items[0].(string)
+		keys, _ := items[1].([]any)
+
+		for _, k := range keys {
+			key, _ := k.(string)
+			key = strings.TrimPrefix(key, s.config.KeyPrefix)
+			if strings.HasPrefix(key, redisCounterPrefix) {
+				continue
+			}
+
+			// the block may have expired since the scan
+			until, ok, err := s.BlockedUntil(key)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				blocks[key] = until
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			return blocks, nil
+		}
+	}
+}
+
+// Increment adds one to the counter at key and returns the new count. The increment and the new TTL are
+// applied together in a transaction, so a counter is never left without a TTL
+func (s *RedisBlockStore) Increment(key string, ttl time.Duration) (int64, error) {
+	key = s.config.KeyPrefix + redisCounterPrefix + key
+
+	replies, err := s.transaction(
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v", replies[0])
+	}
+
+	return count, nil
+}
+
+// ResetCount forgets the counter at key
+func (s *RedisBlockStore) ResetCount(key string) error {
+	_, err := s.do("DEL", s.config.KeyPrefix+redisCounterPrefix+key)
+	return err
+}
+
+// Close closes the connection to Redis
+func (s *RedisBlockStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeConn()
+}
+
+// do sends an idempotent command and returns its reply
+func (s *RedisBlockStore) do(args ...string) (any, error) {
+	replies, err := s.pipeline(true, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// transaction runs the commands in a MULTI/EXEC transaction and returns their replies
+func (s *RedisBlockStore) transaction(commands ...[]string) ([]any, error) {
+	pipeline := append([][]string{{"MULTI"}}, commands...)
+	pipeline = append(pipeline, []string{"EXEC"})
+
+	replies, err := s.pipeline(false, pipeline...)
+	if err != nil {
+		return nil, err
+	}
+
+	results, ok := replies[len(replies)-1].([]any)
+	if !ok || len(results) != len(commands) {
+		return nil, fmt.Errorf("redis: unexpected transaction reply %v", replies[len(replies)-1])
+	}
+	for _, result := range results {
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// pipeline sends the commands in a single write and returns their replies, reconnecting once if the
+// connection had gone away before they were sent. Idempotent commands are also sent again when the server
+// closed the connection without replying, which is how an idle connection closed by Redis shows up. Other
+// commands may have run by then, and replaying an INCR would count it twice
+func (s *RedisBlockStore) pipeline(idempotent bool, commands ...[]string) ([]any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replies, err := s.pipelineLocked(commands...)
+	var notSent redisNotSentError
+	if errors.As(err, &notSent) || (idempotent && errors.Is(err, io.EOF)) {
+		replies, err = s.pipelineLocked(commands...)
+	}
+
+	return replies, err
+}
+
+// pipelineLocked must be called with the lock held
+func (s *RedisBlockStore) pipelineLocked(commands ...[]string) ([]any, error) {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, redisNotSentError{err}
+		}
+	}
+
+	replies, err := s.roundTrip(commands...)
+	var redisErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &redisErr) {
+		// the connection is in an unknown state after a network or protocol error
+		s.closeConn()
+	}
+
+	return replies, err
+}
+
+// connect must be called with the lock held
+func (s *RedisBlockStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.config.Addr, s.config.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.config.Password != "" {
+		if _, err := s.roundTrip([]string{"AUTH", s.config.Password}); err != nil {
+			s.closeConn()
+			return err
+		}
+	}
+
+	if s.config.DB != 0 {
+		if _, err := s.roundTrip([]string{"SELECT", strconv.Itoa(s.config.DB)}); err != nil {
+			s.closeConn()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeConn must be called with the lock held
+func (s *RedisBlockStore) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+	return err
+}
+
+// roundTrip must be called with the lock held. Replies that are Redis errors are returned in place, and
+// the first of them is also returned as the error once every reply has been read
+func (s *RedisBlockStore) roundTrip(commands ...[]string) ([]any, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.config.Timeout)); err != nil {
+		return nil, redisNotSentError{err}
+	}
+
+	var buf []byte
+	for _, args := range commands {
+		buf = append(buf, encodeRESPCommand(args...)...)
+	}
+
+	// Redis does not run a command that was only partly written
+	if _, err := s.conn.Write(buf); err != nil {
+		return nil, redisNotSentError{err}
+	}
+
+	var (
+		replies  = make([]any, len(commands))
+		replyErr error
+	)
+	for i := range replies {
+		reply, err := readRESPReply(s.reader)
+		var redisErr redisError
+		switch {
+		case err == nil:
+			replies[i] = reply
+		case errors.Is(err, errRedisNil) || errors.As(err, &redisErr):
+			replies[i] = err
+			if replyErr == nil {
+				replyErr = err
+			}
+		default:
+			return nil, err
+		}
+	}
+
+	return replies, replyErr
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisNotSentError is a failure to send a command, which is safe to send again on a new connection
+type redisNotSentError struct {
+	err error
+}
+
+func (e redisNotSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e redisNotSentError) Unwrap() error {
+	return e.err
+}
+
+func encodeRESPCommand(args ...string) []byte {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b = append(b, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// readRESPReply reads a single reply. Bulk and simple strings are returned as string, integers as int64
+// and arrays as []any, with any error replies in them as error
+func readRESPReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = readRESPReply(r)
+			// errors within an array, such as the replies of a transaction, are kept in place so the rest
+			// of the array is still read
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				items[i] = err
+			} else if err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
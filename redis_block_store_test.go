@@ -0,0 +1,455 @@
+package mochicloudhooks
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a minimal in-memory stand-in for a Redis server speaking just enough of the protocol for RedisBlockStore
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	values   map[string]string
+	expiry   map[string]time.Time
+	commands []string
+	delay    time.Duration // how long replies are held back after a command has run
+	drop     bool          // close the connection after running a command instead of replying
+	conns    []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeRedis{
+		listener: l,
+		password: password,
+		values:   make(map[string]string),
+		expiry:   make(map[string]time.Time),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+// closeConns closes every connection to the server, as Redis does with idle clients
+func (f *fakeRedis) closeConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// reply sends the reply of a command that has run, reporting whether the connection is still open
+func (f *fakeRedis) reply(conn net.Conn, reply string) bool {
+	f.mu.Lock()
+	delay, drop := f.delay, f.drop
+	f.mu.Unlock()
+
+	if drop {
+		return false
+	}
+	time.Sleep(delay)
+	conn.Write([]byte(reply))
+	return true
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	var queued [][]string
+	multi := false
+	for {
+		reply, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			if args[1] != f.password {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			authed = true
+			conn.Write([]byte("+OK\r\n"))
+			continue
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+
+		switch {
+		case cmd == "MULTI":
+			multi, queued = true, nil
+			conn.Write([]byte("+OK\r\n"))
+			continue
+		case cmd == "EXEC":
+			replies := "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, q := range queued {
+				replies += f.exec(strings.ToUpper(q[0]), q[1:])
+			}
+			multi, queued = false, nil
+			if !f.reply(conn, replies) {
+				return
+			}
+			continue
+		case multi:
+			queued = append(queued, args)
+			conn.Write([]byte("+QUEUED\r\n"))
+			continue
+		}
+
+		if !f.reply(conn, f.exec(cmd, args[1:])) {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commands = append(f.commands, cmd)
+	for key, at := range f.expiry {
+		if !time.Now().Before(at) {
+			delete(f.values, key)
+			delete(f.expiry, key)
+		}
+	}
+
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+	case "SET":
+		f.values[args[0]] = args[1]
+		delete(f.expiry, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			f.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.ParseInt(f.values[args[0]], 10, 64)
+		n++
+		f.values[args[0]] = strconv.FormatInt(n, 10)
+		return ":" + strconv.FormatInt(n, 10) + "\r\n"
+	case "PEXPIRE":
+		if _, ok := f.values[args[0]]; !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[1])
+		f.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SCAN":
+		// the whole keyspace is returned in one batch
+		reply := ""
+		n := 0
+		for key := range f.values {
+			if ok, _ := path.Match(args[2], key); ok {
+				reply += "$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+				n++
+			}
+		}
+		return "*2\r\n$1\r\n0\r\n*" + strconv.Itoa(n) + "\r\n" + reply
+	case "DEL":
+		_, ok := f.values[args[0]]
+		delete(f.values, args[0])
+		delete(f.expiry, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func TestRedisBlockStore(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{
+		Addr:     server.addr(),
+		Password: "secret",
+		DB:       2,
+	})
+	defer store.Close()
+
+	_, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	until := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	require.NoError(t, store.Block("client", until))
+
+	got, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, until.Equal(got))
+
+	server.mu.Lock()
+	require.Contains(t, server.values, "mochi:block:client")
+	require.Contains(t, server.commands, "SELECT")
+	server.mu.Unlock()
+
+	require.NoError(t, store.Unblock("client"))
+	_, ok, err = store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRedisBlockStoreList(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	until := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	require.NoError(t, store.Block("clientid:a", until))
+	require.NoError(t, store.Block("ip:10.0.0.1", until))
+	_, err := store.Increment("fail:clientid:b", time.Minute)
+	require.NoError(t, err)
+
+	// counters are not listed
+	blocks, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.True(t, until.Equal(blocks["clientid:a"]))
+	require.True(t, until.Equal(blocks["ip:10.0.0.1"]))
+}
+
+func TestRedisBlockStoreIncrement(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := store.Increment("fail:clientid:client", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, i, n)
+	}
+
+	// counters do not show up as blocks
+	_, ok, err := store.BlockedUntil("fail:clientid:client")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, store.ResetCount("fail:clientid:client"))
+	n, err := store.Increment("fail:clientid:client", 20*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	require.Eventually(t, func() bool {
+		n, err := store.Increment("fail:clientid:client", 20*time.Millisecond)
+		return err == nil && n == 1
+	}, time.Second, 30*time.Millisecond)
+}
+
+func TestRedisBlockStoreExpiry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	require.NoError(t, store.Block("client", time.Now().Add(20*time.Millisecond)))
+	require.Eventually(t, func() bool {
+		_, ok, err := store.BlockedUntil("client")
+		return err == nil && !ok
+	}, time.Second, 5*time.Millisecond)
+
+	// blocking until a time already passed removes the block instead
+	require.NoError(t, store.Block("client", time.Now().Add(-time.Second)))
+	_, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRedisBlockStoreErrors(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	store := NewRedisBlockStore(RedisBlockStoreConfig{
+		Addr:     server.addr(),
+		Password: "wrong",
+	})
+	defer store.Close()
+
+	_, _, err := store.BlockedUntil("client")
+	require.Error(t, err)
+
+	unreachable := NewRedisBlockStore(RedisBlockStoreConfig{
+		Addr:    "127.0.0.1:1",
+		Timeout: 50 * time.Millisecond,
+	})
+	require.Error(t, unreachable.Block("client", time.Now().Add(time.Minute)))
+}
+
+func TestRedisBlockStoreReconnect(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	require.NoError(t, store.Block("client", time.Now().Add(time.Minute)))
+
+	// the server closing an idle connection is recovered from transparently
+	store.mu.Lock()
+	store.conn.Close()
+	store.mu.Unlock()
+
+	_, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestRedisBlockStoreTimeoutNotReplayed(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr(), Timeout: 20 * time.Millisecond})
+	defer store.Close()
+
+	// an INCR that Redis ran but whose reply timed out is not sent again
+	server.mu.Lock()
+	server.delay = 50 * time.Millisecond
+	server.mu.Unlock()
+	_, err := store.Increment("fail:clientid:client", time.Minute)
+	require.Error(t, err)
+
+	server.mu.Lock()
+	server.delay = 0
+	server.mu.Unlock()
+	n, err := store.Increment("fail:clientid:client", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+}
+
+func TestRedisBlockStoreDroppedNotReplayed(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	// an INCR that Redis ran before the connection dropped is not sent again
+	server.mu.Lock()
+	server.drop = true
+	server.mu.Unlock()
+	_, err := store.Increment("fail:clientid:client", time.Minute)
+	require.Error(t, err)
+
+	server.mu.Lock()
+	server.drop = false
+	server.mu.Unlock()
+	n, err := store.Increment("fail:clientid:client", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	// the counter and its TTL are set together
+	server.mu.Lock()
+	_, ok := server.expiry[store.config.KeyPrefix+redisCounterPrefix+"fail:clientid:client"]
+	server.mu.Unlock()
+	require.True(t, ok)
+}
+
+func TestRedisBlockStoreIdleConnectionClosed(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+	defer store.Close()
+
+	require.NoError(t, store.Block("client", time.Now().Add(time.Minute)))
+
+	// an idempotent command is sent again on a new connection when the server closed the idle one
+	server.closeConns()
+	time.Sleep(10 * time.Millisecond)
+	_, ok, err := store.BlockedUntil("client")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// while an increment is not, as the server may have run it
+	server.closeConns()
+	time.Sleep(10 * time.Millisecond)
+	_, err = store.Increment("fail:clientid:client", time.Minute)
+	require.Error(t, err)
+	n, err := store.Increment("fail:clientid:client", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+}
+
+func TestHTTPAuthHookSharedBlockStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRT := NewMockRoundTripper(ctrl)
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Body:       http.NoBody,
+	}, nil).Times(1)
+
+	server := newFakeRedis(t, "")
+	config := HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		Timeout: TimeoutConfig{
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	// two brokers sharing one store
+	brokers := make([]*HTTPAuthHook, 2)
+	for i := range brokers {
+		config.BlockStore = NewRedisBlockStore(RedisBlockStoreConfig{Addr: server.addr()})
+		brokers[i] = new(HTTPAuthHook)
+		brokers[i].Log = &zerolog.Logger{}
+		require.NoError(t, brokers[i].Init(config))
+	}
+
+	cl := &mqtt.Client{ID: defaultClientID}
+	require.False(t, brokers[0].OnACLCheck(cl, "/topic", true))
+
+	// the client blocked on the first broker is blocked on the second without a request
+	require.False(t, brokers[1].OnACLCheck(cl, "/topic", true))
+}
@@ -0,0 +1,204 @@
+package mochicloudhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// RequestEncoding decides how the fields of a request are sent to an auth endpoint
+type RequestEncoding int
+
+const (
+	// EncodingJSON sends the fields as a JSON object in the request body
+	EncodingJSON RequestEncoding = iota
+	// EncodingForm sends the fields as an application/x-www-form-urlencoded request body
+	EncodingForm
+	// EncodingQuery sends the fields as URL query parameters without a request body
+	EncodingQuery
+)
+
+// RequestConfig configures how requests to a single auth endpoint are built
+type RequestConfig struct {
+	Method     string // defaults to GET for EncodingQuery and POST otherwise
+	Encoding   RequestEncoding
+	FieldNames map[string]string // renames fields, e.g. {"clientid": "client_id"}. A field renamed to "" is omitted
+	Fields     map[string]string // replaces the default fields with text/template values rendered from RequestTemplateData
+}
+
+// requestPayload is implemented by every request sent to the auth endpoints
+type requestPayload interface {
+	fields() map[string]any
+}
+
+func (p SuperuserCheckPOST) fields() map[string]any {
+	return map[string]any{
+		"username": p.Username,
+	}
+}
+
+func (p ClientCheckPOST) fields() map[string]any {
+	return map[string]any{
+		"clientid": p.ClientID,
+		"password": p.Password,
+		"username": p.Username,
+	}
+}
+
+func (p ACLCheckPOST) fields() map[string]any {
+	return map[string]any{
+		"username": p.Username,
+		"clientid": p.ClientID,
+		"topic":    p.Topic,
+		"acc":      int(p.ACC),
+	}
+}
+
+// endpointRequest builds requests for a single auth endpoint from its compiled RequestConfig
+type endpointRequest struct {
+	config    RequestConfig
+	templates map[string]*template.Template
+}
+
+func newEndpointRequest(rc RequestConfig) (*endpointRequest, error) {
+	if rc.Encoding < EncodingJSON || rc.Encoding > EncodingQuery {
+		return nil, fmt.Errorf("unknown request encoding %d", rc.Encoding)
+	}
+
+	er := &endpointRequest{
+		config:    rc,
+		templates: make(map[string]*template.Template, len(rc.Fields)),
+	}
+
+	for name, text := range rc.Fields {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for field %s: %w", name, err)
+		}
+		er.templates[name] = tmpl
+	}
+
+	return er, nil
+}
+
+// newRequest builds a request to endpoint carrying either the payload's fields or the configured templates
+func (er *endpointRequest) newRequest(ctx context.Context, endpoint string, payload requestPayload, data RequestTemplateData) (*http.Request, error) {
+	fields, err := er.fields(payload, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAuthRequest(ctx, er.config, endpoint, fields)
+}
+
+func (er *endpointRequest) fields(payload requestPayload, data RequestTemplateData) (map[string]any, error) {
+	if len(er.templates) == 0 {
+		if payload == nil {
+			return nil, nil
+		}
+		return renameFields(payload.fields(), er.config.FieldNames), nil
+	}
+
+	fields := make(map[string]any, len(er.templates))
+	for name, tmpl := range er.templates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("failed to render field %s: %w", name, err)
+		}
+		fields[name] = b.String()
+	}
+
+	return fields, nil
+}
+
+// newAuthRequest builds a request for an auth endpoint using the endpoint's method and encoding
+func newAuthRequest(ctx context.Context, rc RequestConfig, endpoint string, fields map[string]any) (*http.Request, error) {
+	method := rc.Method
+	if method == "" {
+		method = http.MethodPost
+		if rc.Encoding == EncodingQuery {
+			method = http.MethodGet
+		}
+	}
+
+	if fields == nil {
+		return http.NewRequestWithContext(ctx, method, endpoint, http.NoBody)
+	}
+
+	var (
+		body        io.Reader = http.NoBody
+		contentType string
+	)
+
+	switch rc.Encoding {
+	case EncodingJSON:
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	case EncodingForm:
+		body = strings.NewReader(formValues(fields).Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case EncodingQuery:
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		for k, v := range formValues(fields) {
+			query[k] = v
+		}
+		u.RawQuery = query.Encode()
+		endpoint = u.String()
+	default:
+		return nil, errors.New("unknown request encoding")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+func renameFields(fields map[string]any, names map[string]string) map[string]any {
+	if len(names) == 0 {
+		return fields
+	}
+
+	renamed := make(map[string]any, len(fields))
+	for k, v := range fields {
+		name, ok := names[k]
+		if !ok {
+			name = k
+		}
+		if name == "" {
+			continue
+		}
+		renamed[name] = v
+	}
+
+	return renamed
+}
+
+func formValues(fields map[string]any) url.Values {
+	values := make(url.Values, len(fields))
+	for k, v := range fields {
+		values.Set(k, fmt.Sprint(v))
+	}
+	return values
+}
@@ -0,0 +1,238 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuthRequest(t *testing.T) {
+	payload := ClientCheckPOST{
+		ClientID: "client",
+		Password: "pass word",
+		Username: "user",
+	}
+
+	tests := []struct {
+		name              string
+		config            RequestConfig
+		payload           requestPayload
+		expectMethod      string
+		expectURL         string
+		expectContentType string
+		expectBody        string
+		expectErr         bool
+	}{
+		{
+			name:              "Success - JSON by default",
+			config:            RequestConfig{},
+			payload:           payload,
+			expectMethod:      http.MethodPost,
+			expectURL:         "http://authhost.com/auth",
+			expectContentType: "application/json",
+			expectBody:        `{"clientid":"client","password":"pass word","username":"user"}`,
+		},
+		{
+			name:              "Success - Form encoded",
+			config:            RequestConfig{Encoding: EncodingForm},
+			payload:           payload,
+			expectMethod:      http.MethodPost,
+			expectURL:         "http://authhost.com/auth",
+			expectContentType: "application/x-www-form-urlencoded",
+			expectBody:        "clientid=client&password=pass+word&username=user",
+		},
+		{
+			name:         "Success - Query encoded",
+			config:       RequestConfig{Encoding: EncodingQuery},
+			payload:      payload,
+			expectMethod: http.MethodGet,
+			expectURL:    "http://authhost.com/auth?clientid=client&password=pass+word&username=user",
+		},
+		{
+			name: "Success - Renamed and omitted fields",
+			config: RequestConfig{
+				Method:   http.MethodPut,
+				Encoding: EncodingForm,
+				FieldNames: map[string]string{
+					"clientid": "client_id",
+					"password": "",
+				},
+			},
+			payload:           payload,
+			expectMethod:      http.MethodPut,
+			expectURL:         "http://authhost.com/auth",
+			expectContentType: "application/x-www-form-urlencoded",
+			expectBody:        "client_id=client&username=user",
+		},
+		{
+			name:         "Success - Nil payload",
+			config:       RequestConfig{},
+			expectMethod: http.MethodPost,
+			expectURL:    "http://authhost.com/auth",
+		},
+		{
+			name:      "Error - Unknown encoding",
+			config:    RequestConfig{Encoding: RequestEncoding(99)},
+			payload:   payload,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er, err := newEndpointRequest(tt.config)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			req, err := er.newRequest(context.Background(), "http://authhost.com/auth", tt.payload, RequestTemplateData{})
+			require.NoError(t, err)
+
+			body, _ := io.ReadAll(req.Body)
+			require.Equal(t, tt.expectMethod, req.Method)
+			require.Equal(t, tt.expectURL, req.URL.String())
+			require.Equal(t, tt.expectContentType, req.Header.Get("Content-Type"))
+			require.Equal(t, tt.expectBody, string(body))
+		})
+	}
+}
+
+func TestInitInvalidRequestConfig(t *testing.T) {
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+
+	err := authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  "http://aclhost.com",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ACLRequest:               RequestConfig{Encoding: RequestEncoding(99)},
+	})
+	require.Error(t, err)
+}
+
+func TestHTTPAuthHookRequestConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		RoundTripper:             mockRT,
+		ACLHost:                  "http://aclhost.com/acl",
+		ClientAuthenticationHost: "http://clientauthenticationhost.com",
+		ACLRequest: RequestConfig{
+			Encoding:   EncodingQuery,
+			FieldNames: map[string]string{"acc": "access"},
+		},
+	}))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, http.MethodGet, r.Method)
+		require.Equal(t, defaultClientID, r.URL.Query().Get("clientid"))
+		require.Equal(t, "/topic", r.URL.Query().Get("topic"))
+		require.Equal(t, "2", r.URL.Query().Get("access"))
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", true))
+}
+
+func TestRequestTemplateFields(t *testing.T) {
+	cl := &mqtt.Client{ID: defaultClientID}
+	cl.Net.Remote = "10.0.0.1:51234"
+	cl.Net.Listener = "tcp1"
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			Username:  []byte("user"),
+			Password:  []byte("pass"),
+			Clean:     true,
+			Keepalive: 30,
+		},
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "region", Val: "eu"}},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		fields       map[string]string
+		data         RequestTemplateData
+		expectFields map[string]any
+		expectErr    bool
+	}{
+		{
+			name: "Success - Connect metadata",
+			fields: map[string]string{
+				"client":    "{{.ClientID}}",
+				"user":      "{{.Username}}",
+				"pass":      "{{.Password}}",
+				"ip":        "{{.RemoteIP}}",
+				"addr":      "{{.RemoteAddr}}",
+				"listener":  "{{.Listener}}",
+				"version":   "{{.ProtocolVersion}}",
+				"clean":     "{{.CleanStart}}",
+				"keepalive": "{{.Keepalive}}",
+				"region":    `{{index .UserProperties "region"}}`,
+			},
+			data: newRequestTemplateData(cl, pk),
+			expectFields: map[string]any{
+				"client":    defaultClientID,
+				"user":      "user",
+				"pass":      "pass",
+				"ip":        "10.0.0.1",
+				"addr":      "10.0.0.1:51234",
+				"listener":  "tcp1",
+				"version":   "5",
+				"clean":     "true",
+				"keepalive": "30",
+				"region":    "eu",
+			},
+		},
+		{
+			name: "Success - ACL metadata",
+			fields: map[string]string{
+				"topic": "{{.Topic}}",
+				"acc":   "{{.Access}}",
+				"who":   "{{.ClientID}}@{{.Listener}}",
+			},
+			data: newACLTemplateData(cl, "/topic", ACLAccessSubscribe),
+			expectFields: map[string]any{
+				"topic": "/topic",
+				"acc":   "4",
+				"who":   defaultClientID + "@tcp1",
+			},
+		},
+		{
+			name:      "Error - Invalid template",
+			fields:    map[string]string{"broken": "{{.ClientID"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er, err := newEndpointRequest(RequestConfig{Fields: tt.fields})
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			fields, err := er.fields(nil, tt.data)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectFields, fields)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package mochicloudhooks
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// RequestTemplateData is the data available to the templates in RequestConfig.Fields, e.g. "{{.RemoteIP}}".
+// Password, Keepalive and Packet are only set for connect requests, Topic and Access only for ACL requests.
+// Access is the numeric ACLAccess of the check
+type RequestTemplateData struct {
+	ClientID        string
+	Username        string
+	Password        string
+	RemoteAddr      string
+	RemoteIP        string
+	Listener        string
+	ProtocolVersion byte
+	CleanStart      bool
+	Keepalive       uint16
+	UserProperties  map[string]string
+	Topic           string
+	Access          string
+	Client          *mqtt.Client
+	Packet          packets.Packet
+}
+
+func newRequestTemplateData(cl *mqtt.Client, pk packets.Packet) RequestTemplateData {
+	data := RequestTemplateData{
+		ClientID:        cl.ID,
+		Username:        string(cl.Properties.Username),
+		RemoteAddr:      cl.Net.Remote,
+		RemoteIP:        remoteIP(cl.Net.Remote),
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		CleanStart:      cl.Properties.Clean,
+		UserProperties:  userProperties(cl.Properties.Props.User),
+		Client:          cl,
+		Packet:          pk,
+	}
+
+	// the connect packet is authoritative while the client is still being authenticated
+	if pk.FixedHeader.Type == packets.Connect {
+		data.Username = string(pk.Connect.Username)
+		data.Password = string(pk.Connect.Password)
+		data.ProtocolVersion = pk.ProtocolVersion
+		data.CleanStart = pk.Connect.Clean
+		data.Keepalive = pk.Connect.Keepalive
+		data.UserProperties = userProperties(pk.Properties.User)
+	}
+
+	return data
+}
+
+func newACLTemplateData(cl *mqtt.Client, topic string, access ACLAccess) RequestTemplateData {
+	data := newRequestTemplateData(cl, packets.Packet{})
+	data.Topic = topic
+	data.Access = strconv.Itoa(int(access))
+	return data
+}
+
+// remoteIP strips the port from a remote address, returning the address unchanged if it has none
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func userProperties(props []packets.UserProperty) map[string]string {
+	if len(props) == 0 {
+		return nil
+	}
+
+	m := make(map[string]string, len(props))
+	for _, p := range props {
+		m[p.Key] = p.Val
+	}
+	return m
+}
@@ -0,0 +1,192 @@
+package mochicloudhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// secretDocument is a secret holding users and the roles they can be given, e.g.
+//
+//	{
+//		"users": [{"username": "device", "password": "$2b$...", "roles": ["device"]}],
+//		"roles": {"device": {"publish": {"allow": ["devices/%c/#"]}, "subscribe": {"allow": ["commands/%c"]}}}
+//	}
+type secretDocument struct {
+	Users []secretUser        `json:"users"`
+	Roles map[string]aclRules `json:"roles"`
+}
+
+type secretUser struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Superuser bool     `json:"superuser"` // allowed every topic
+	Roles     []string `json:"roles"`     // roles whose rules apply to the user, from any of the secrets
+	ACL       aclRules `json:"acl"`       // rules of the user alongside those of its roles
+}
+
+// aclRules are the topic filters a user may publish and subscribe to
+type aclRules struct {
+	Publish   topicRules `json:"publish"`
+	Subscribe topicRules `json:"subscribe"`
+}
+
+// topicRules allow the topics matched by Allow unless they are matched by Deny. Filters may use %u for
+// the username and %c for the client id
+type topicRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (r topicRules) merge(other topicRules) topicRules {
+	return topicRules{
+		Allow: append(append([]string{}, r.Allow...), other.Allow...),
+		Deny:  append(append([]string{}, r.Deny...), other.Deny...),
+	}
+}
+
+// credential is a user read from the secrets
+type credential struct {
+	username  string
+	password  passwordHash
+	superuser bool
+	rules     aclRules
+	roles     []string
+}
+
+// parseCredentials parses secrets holding either a JSON secretDocument or a single username:hash, as in a
+// mosquitto password file. A username:hash secret describes a superuser
+func parseCredentials(secrets []string) (map[string]credential, error) {
+	credentials := make(map[string]credential)
+	roles := make(map[string]aclRules)
+
+	for _, secret := range secrets {
+		var creds []credential
+		if strings.HasPrefix(strings.TrimSpace(secret), "{") {
+			var doc secretDocument
+			if err := json.Unmarshal([]byte(secret), &doc); err != nil {
+				return nil, fmt.Errorf("invalid secret document: %w", err)
+			}
+			for name, rules := range doc.Roles {
+				if _, ok := roles[name]; ok {
+					return nil, fmt.Errorf("role %s is defined more than once", name)
+				}
+				roles[name] = rules
+			}
+			for _, user := range doc.Users {
+				cred, err := parseSecretUser(user)
+				if err != nil {
+					return nil, err
+				}
+				creds = append(creds, cred)
+			}
+		} else {
+			cred, err := parseCredential(secret)
+			if err != nil {
+				return nil, err
+			}
+			creds = append(creds, cred)
+		}
+
+		for _, cred := range creds {
+			if _, ok := credentials[cred.username]; ok {
+				return nil, fmt.Errorf("user %s is defined more than once", cred.username)
+			}
+			credentials[cred.username] = cred
+		}
+	}
+
+	// roles may be defined in a different secret than the users given them
+	for username, cred := range credentials {
+		for _, name := range cred.roles {
+			rules, ok := roles[name]
+			if !ok {
+				return nil, fmt.Errorf("user %s has undefined role %s", username, name)
+			}
+			cred.rules.Publish = cred.rules.Publish.merge(rules.Publish)
+			cred.rules.Subscribe = cred.rules.Subscribe.merge(rules.Subscribe)
+		}
+		credentials[username] = cred
+	}
+
+	return credentials, nil
+}
+
+func parseSecretUser(user secretUser) (credential, error) {
+	if user.Username == "" {
+		return credential{}, errors.New("user has no username")
+	}
+
+	password, err := parsePasswordHash(user.Password)
+	if err != nil {
+		return credential{}, fmt.Errorf("credential for %s: %w", user.Username, err)
+	}
+
+	return credential{
+		username:  user.Username,
+		password:  password,
+		superuser: user.Superuser,
+		rules:     user.ACL,
+		roles:     user.Roles,
+	}, nil
+}
+
+// parseCredential parses a secret of the form username:hash
+func parseCredential(secret string) (credential, error) {
+	username, encoded, ok := strings.Cut(strings.TrimSpace(secret), ":")
+	if !ok || username == "" {
+		return credential{}, errors.New("credential is not of the form username:hash")
+	}
+
+	password, err := parsePasswordHash(encoded)
+	if err != nil {
+		return credential{}, fmt.Errorf("credential for %s: %w", username, err)
+	}
+
+	return credential{username: username, password: password, superuser: true}, nil
+}
+
+// allows reports whether the credential's rules allow a client to publish to a topic, or to subscribe to
+// a topic filter. Deny rules take precedence and anything not allowed is denied
+func (c credential) allows(clientID, topic string, write bool) bool {
+	if c.superuser {
+		return true
+	}
+
+	rules := c.rules.Subscribe
+	if write {
+		rules = c.rules.Publish
+	}
+
+	for _, filter := range rules.Deny {
+		filter, _ := substituteFilter(filter, c.username, clientID)
+		// a subscription is denied if it could receive any denied topic
+		if (write && matchTopicFilter(filter, topic)) || (!write && topicFiltersOverlap(filter, topic)) {
+			return false
+		}
+	}
+
+	for _, filter := range rules.Allow {
+		filter, ok := substituteFilter(filter, c.username, clientID)
+		if ok && matchTopicFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// substituteFilter replaces %u with the username and %c with the client id. It reports false if a
+// substituted value contains a topic separator or wildcard, which would widen the filter
+func substituteFilter(filter, username, clientID string) (string, bool) {
+	ok := true
+	if strings.Contains(filter, "%u") && strings.ContainsAny(username, "/+#") {
+		ok = false
+	}
+	if strings.Contains(filter, "%c") && strings.ContainsAny(clientID, "/+#") {
+		ok = false
+	}
+
+	return strings.NewReplacer("%u", username, "%c", clientID).Replace(filter), ok
+}
@@ -0,0 +1,132 @@
+package mochicloudhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredential(t *testing.T) {
+	tests := []struct {
+		name        string
+		secret      string
+		expectError bool
+	}{
+		{
+			name:   "Success - Trailing Newline",
+			secret: "admin:$7$101$MDEyMzQ1Njc4OWFiY2RlZg==$YWJj\n",
+		},
+		{
+			name:        "Error - Username Only",
+			secret:      "admin",
+			expectError: true,
+		},
+		{
+			name:        "Error - Plain Password",
+			secret:      "admin:password",
+			expectError: true,
+		},
+		{
+			name:        "Error - Malformed Argon2id",
+			secret:      "admin:$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+			expectError: true,
+		},
+		{
+			name:        "Error - Unknown Algorithm",
+			secret:      "admin:$1$salt$hash",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := parseCredential(tt.secret)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "admin", cred.username)
+		})
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	hash := testPasswordHashes(t, "secret")["mosquitto"]
+
+	users := `{"users": [
+		{"username": "device", "password": "` + hash + `", "roles": ["device"], "acl": {"publish": {"allow": ["status/%u"]}}},
+		{"username": "admin", "password": "` + hash + `", "superuser": true}
+	]}`
+	roles := `{"roles": {"device": {"publish": {"allow": ["devices/%c/#"]}}}}`
+
+	credentials, err := parseCredentials([]string{users, roles, "ops:" + hash})
+	require.NoError(t, err)
+	require.Len(t, credentials, 3)
+	require.Equal(t, []string{"status/%u", "devices/%c/#"}, credentials["device"].rules.Publish.Allow)
+	require.True(t, credentials["admin"].superuser)
+	require.True(t, credentials["ops"].superuser)
+
+	tests := []struct {
+		name    string
+		secrets []string
+	}{
+		{name: "Error - Invalid JSON", secrets: []string{`{"users": [`}},
+		{name: "Error - Undefined Role", secrets: []string{users}},
+		{name: "Error - Duplicate User", secrets: []string{users, roles, "device:" + hash}},
+		{name: "Error - Duplicate Role", secrets: []string{users, roles, roles}},
+		{name: "Error - Missing Username", secrets: []string{`{"users": [{"password": "` + hash + `"}]}`}},
+		{name: "Error - Invalid Password", secrets: []string{`{"users": [{"username": "device", "password": "secret"}]}`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCredentials(tt.secrets)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCredentialAllows(t *testing.T) {
+	cred := credential{
+		username: "device",
+		rules: aclRules{
+			Publish: topicRules{
+				Allow: []string{"devices/%c/#", "status/%u"},
+				Deny:  []string{"devices/%c/config"},
+			},
+			Subscribe: topicRules{
+				Allow: []string{"commands/%u/#", "broadcast/#"},
+				Deny:  []string{"broadcast/internal"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		clientID    string
+		topic       string
+		write       bool
+		expectAllow bool
+	}{
+		{name: "Success - Publish Client ID", clientID: "d1", topic: "devices/d1/telemetry", write: true, expectAllow: true},
+		{name: "Success - Publish Username", clientID: "d1", topic: "status/device", write: true, expectAllow: true},
+		{name: "Success - Subscribe Narrower Filter", clientID: "d1", topic: "commands/device/+", expectAllow: true},
+		{name: "Success - Subscribe Clear Of Deny", clientID: "d1", topic: "broadcast/public/#", expectAllow: true},
+		{name: "Error - Publish Other Client", clientID: "d1", topic: "devices/d2/telemetry", write: true},
+		{name: "Error - Publish Denied", clientID: "d1", topic: "devices/d1/config", write: true},
+		{name: "Error - Subscribe Only Rule", clientID: "d1", topic: "commands/device/reboot", write: true},
+		{name: "Error - Subscribe Wider Filter", clientID: "d1", topic: "commands/#"},
+		{name: "Error - Subscribe Overlaps Deny", clientID: "d1", topic: "broadcast/#"},
+		{name: "Error - Wildcard Client ID", clientID: "#", topic: "devices/d2/telemetry", write: true},
+		{name: "Error - Separator In Client ID", clientID: "d1/../d2", topic: "devices/d1/../d2/x", write: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectAllow, cred.allows(tt.clientID, tt.topic, tt.write))
+		})
+	}
+
+	require.True(t, credential{superuser: true}.allows("d1", "anything", true))
+}
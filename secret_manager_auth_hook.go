@@ -5,23 +5,45 @@ import (
 	"context"
 	"errors"
 	"fmt"
-
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mochi-co/mqtt/v2"
 	"github.com/mochi-co/mqtt/v2/packets"
 )
 
 type SecretManagerAuthHook struct {
-	usernames []string
+	credentials atomic.Pointer[map[string]credential]
+	provider    SecretProvider
+	ownedGCP    *GCPSecretProvider
+	names       []string
+	mode        SecretManagerMode
+	mu          sync.Mutex
+	sessions    map[*mqtt.Client]string
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
 	mqtt.HookBase
 }
 
 type SecretManagerHookConfig struct {
-	Names []string
+	Names           []string       // secrets each holding a JSON document of users and roles, or a superuser as username:hash
+	RefreshInterval time.Duration  // how often the secrets are read again, refreshing is disabled when zero
+	Provider        SecretProvider // where the secrets are read from, defaults to GCP Secret Manager
+	Mode            SecretManagerMode
 }
 
+// SecretManagerMode decides what the hook does with clients it has no credential for
+type SecretManagerMode int
+
+const (
+	// SecretManagerModeAuthoritative denies clients without a matching credential
+	SecretManagerModeAuthoritative SecretManagerMode = iota
+	// SecretManagerModeSuperuserOnly only allows superusers and abstains for every other client, leaving
+	// them to other hooks
+	SecretManagerModeSuperuserOnly
+)
+
 func (h *SecretManagerAuthHook) ID() string {
 	return "secret-manager-auth-hook"
 }
@@ -30,6 +52,7 @@ func (h *SecretManagerAuthHook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
 		mqtt.OnACLCheck,
 		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
 	}, []byte{b})
 }
 
@@ -45,50 +68,177 @@ func (h *SecretManagerAuthHook) Init(config any) error {
 		return errors.New("improper config")
 	}
 
-	usernames, err := getAdminCredentials(ctx, secretManagerHookConfig.Names)
-	if err != nil {
+	h.provider = secretManagerHookConfig.Provider
+	if h.provider == nil {
+		gcp, err := NewGCPSecretProvider(ctx)
+		if err != nil {
+			return err
+		}
+		h.ownedGCP = gcp
+		h.provider = gcp
+	}
+	h.names = secretManagerHookConfig.Names
+	h.mode = secretManagerHookConfig.Mode
+	h.sessions = make(map[*mqtt.Client]string)
+
+	if err := h.refresh(ctx); err != nil {
+		if h.ownedGCP != nil {
+			h.ownedGCP.Close()
+		}
 		return err
 	}
-	h.usernames = usernames
+	if secretManagerHookConfig.RefreshInterval > 0 {
+		h.startRefresh(secretManagerHookConfig.RefreshInterval)
+	}
 
 	return nil
 }
 
+// Stop stops refreshing the secrets and waits for an in-flight refresh to finish. A configured Provider is
+// left open
+func (h *SecretManagerAuthHook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+	if h.ownedGCP != nil {
+		return h.ownedGCP.Close()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate allows a client whose username and password match a stored credential
 func (h *SecretManagerAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
-	return h.checkAdminCredentials(string(cl.Properties.Username))
+	return h.DecideConnect(cl, pk) == AuthAllow
 }
 
+// DecideConnect allows a client whose username and password match a stored credential. In
+// SecretManagerModeSuperuserOnly it abstains unless the credential is a superuser's
+func (h *SecretManagerAuthHook) DecideConnect(cl *mqtt.Client, pk packets.Packet) AuthDecision {
+	username := string(pk.Connect.Username)
+	cred, ok := h.currentCredentials()[username]
+
+	// a password is always verified so unknown usernames take as long to reject as wrong passwords
+	password := dummyPasswordHash
+	if ok {
+		password = cred.password
+	}
+	verified := password.verify(pk.Connect.Password) && ok
+
+	if h.mode == SecretManagerModeSuperuserOnly && (!ok || !cred.superuser) {
+		return AuthAbstain
+	}
+	if !verified {
+		// a wrong superuser password is left to other hooks, which may know the username too
+		if h.mode == SecretManagerModeSuperuserOnly {
+			return AuthAbstain
+		}
+		return AuthDeny
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessions[cl] = username
+
+	return AuthAllow
+}
+
+// OnACLCheck checks the topic against the current rules of the credential the client authenticated with.
+// Superusers are allowed everything, and a revoked credential is allowed nothing
 func (h *SecretManagerAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	return h.checkAdminCredentials(string(cl.Properties.Username))
+	return h.DecideACL(cl, topic, write) == AuthAllow
 }
 
-func (h *SecretManagerAuthHook) checkAdminCredentials(username string) bool {
-	for _, storedUsername := range h.usernames {
-		if username == storedUsername {
-			return true
+// DecideACL checks the topic for clients authenticated by the hook and abstains for others. In
+// SecretManagerModeAuthoritative clients the hook did not authenticate are denied
+func (h *SecretManagerAuthHook) DecideACL(cl *mqtt.Client, topic string, write bool) AuthDecision {
+	h.mu.Lock()
+	username, ok := h.sessions[cl]
+	h.mu.Unlock()
+
+	cred, known := h.currentCredentials()[username]
+	if h.mode == SecretManagerModeSuperuserOnly {
+		if ok && known && cred.superuser {
+			return AuthAllow
 		}
+		return AuthAbstain
+	}
+
+	if !ok || !known {
+		return AuthDeny
+	}
+	return boolDecision(cred.allows(cl.ID, topic, write))
+}
+
+// OnDisconnect ends the client's session
+func (h *SecretManagerAuthHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, cl)
+}
+
+// currentCredentials returns the credentials read by the last successful refresh
+func (h *SecretManagerAuthHook) currentCredentials() map[string]credential {
+	credentials := h.credentials.Load()
+	if credentials == nil {
+		return nil
 	}
-	return false
+	return *credentials
 }
 
-func getAdminCredentials(ctx context.Context, names []string) ([]string, error) {
-	client, err := secretmanager.NewClient(ctx)
+// refresh reads and parses the secrets and swaps them in. The current credentials are kept if any secret
+// can not be read or parsed
+func (h *SecretManagerAuthHook) refresh(ctx context.Context) error {
+	secrets, err := getAdminCredentials(ctx, h.provider, h.names)
 	if err != nil {
-		return []string{}, fmt.Errorf("failed to create secretmanager client: %v", err)
+		return err
+	}
+
+	credentials, err := parseCredentials(secrets)
+	if err != nil {
+		return err
 	}
-	defer client.Close()
+	h.credentials.Store(&credentials)
+
+	return nil
+}
+
+// startRefresh refreshes the secrets every interval until Stop is called
+func (h *SecretManagerAuthHook) startRefresh(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := h.refresh(ctx); err != nil && ctx.Err() == nil {
+					h.Log.Error().Err(err).Str("hook", h.ID()).Msg("failed to refresh secrets, keeping previous credentials")
+				}
+			}
+		}
+	}()
+}
 
-	var usernames []string
+func getAdminCredentials(ctx context.Context, provider SecretProvider, names []string) ([]string, error) {
+	var secrets []string
 	for _, name := range names {
-		resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
-			Name: name,
-		})
+		secret, err := provider.GetSecret(ctx, name)
 		if err != nil {
-			return []string{}, err
+			return []string{}, fmt.Errorf("failed to read secret %s: %w", name, err)
 		}
 
-		usernames = append(usernames, string(resp.Payload.Data))
+		secrets = append(secrets, string(secret))
 	}
 
-	return usernames, nil
+	return secrets, nil
 }
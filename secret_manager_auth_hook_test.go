@@ -1 +1,242 @@
 package mochicloudhooks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// testSecrets is a SecretProvider serving a changeable set of secrets
+type testSecrets struct {
+	mu      sync.Mutex
+	secrets map[string]string
+	err     error
+	reads   int
+}
+
+func (s *testSecrets) set(name, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets == nil {
+		s.secrets = make(map[string]string)
+	}
+	s.secrets[name] = secret
+}
+
+func (s *testSecrets) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *testSecrets) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, errors.New("secret not found")
+	}
+	return []byte(secret), nil
+}
+
+func (s *testSecrets) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func newTestSecretManagerAuthHook(t *testing.T, secrets *testSecrets, names ...string) *SecretManagerAuthHook {
+	authHook := new(SecretManagerAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(SecretManagerHookConfig{
+		Names:    names,
+		Provider: secrets,
+	}))
+	t.Cleanup(func() { authHook.Stop() })
+	return authHook
+}
+
+func adminConnect(username, password string) packets.Packet {
+	pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte(username)}}
+	if password != "" {
+		pk.Connect.Password = []byte(password)
+	}
+	return pk
+}
+
+func TestSecretManagerAuthHookAuthenticate(t *testing.T) {
+	secrets := &testSecrets{}
+	secrets.set("admin", "admin:"+testPasswordHashes(t, "secret")["bcrypt"])
+	authHook := newTestSecretManagerAuthHook(t, secrets, "admin")
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - Matching Password",
+			username:   "admin",
+			password:   "secret",
+			expectPass: true,
+		},
+		{
+			name:     "Error - Wrong Password",
+			username: "admin",
+			password: "wrong",
+		},
+		{
+			name:     "Error - No Password",
+			username: "admin",
+		},
+		{
+			name:     "Error - Unknown Username",
+			username: "other",
+			password: "secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := &mqtt.Client{ID: defaultClientID}
+			cl.Properties.Username = []byte(tt.username)
+
+			require.Equal(t, tt.expectPass, authHook.OnConnectAuthenticate(cl, adminConnect(tt.username, tt.password)))
+			require.Equal(t, tt.expectPass, authHook.OnACLCheck(cl, "/topic", true))
+
+			authHook.OnDisconnect(cl, nil, false)
+			require.False(t, authHook.OnACLCheck(cl, "/topic", true))
+		})
+	}
+}
+
+func TestSecretManagerAuthHookRefresh(t *testing.T) {
+	hashes := testPasswordHashes(t, "secret")
+	rotated := testPasswordHashes(t, "rotated")
+
+	secrets := &testSecrets{}
+	secrets.set("admin", "admin:"+hashes["bcrypt"])
+	secrets.set("ops", "ops:"+hashes["argon2id"])
+	authHook := newTestSecretManagerAuthHook(t, secrets, "admin", "ops")
+
+	cl := &mqtt.Client{ID: "ops"}
+	require.True(t, authHook.OnConnectAuthenticate(cl, adminConnect("ops", "secret")))
+
+	// a rotated password replaces the old one and a revoked username ends the superuser session
+	secrets.set("admin", "admin:"+rotated["bcrypt"])
+	secrets.set("ops", "operator:"+hashes["argon2id"])
+	require.NoError(t, authHook.refresh(context.Background()))
+	require.False(t, authHook.OnConnectAuthenticate(&mqtt.Client{}, adminConnect("admin", "secret")))
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{}, adminConnect("admin", "rotated")))
+	require.False(t, authHook.OnACLCheck(cl, "/topic", true))
+
+	// the last good credentials are kept when a refresh fails
+	secrets.fail(errors.New("unavailable"))
+	require.Error(t, authHook.refresh(context.Background()))
+	secrets.fail(nil)
+	secrets.set("ops", "operator:not-a-hash")
+	require.Error(t, authHook.refresh(context.Background()))
+	require.True(t, authHook.OnConnectAuthenticate(&mqtt.Client{}, adminConnect("admin", "rotated")))
+}
+
+func TestSecretManagerAuthHookRefreshInterval(t *testing.T) {
+	secrets := &testSecrets{}
+	secrets.set("admin", "admin:"+testPasswordHashes(t, "secret")["bcrypt"])
+	authHook := newTestSecretManagerAuthHook(t, secrets, "admin")
+
+	authHook.startRefresh(time.Millisecond)
+	require.Eventually(t, func() bool { return secrets.readCount() > 2 }, time.Second, time.Millisecond)
+
+	require.NoError(t, authHook.Stop())
+	reads := secrets.readCount()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, reads, secrets.readCount())
+}
+
+func TestSecretManagerAuthHookInit(t *testing.T) {
+	authHook := new(SecretManagerAuthHook)
+	authHook.Log = &zerolog.Logger{}
+
+	require.Error(t, authHook.Init(nil))
+	require.Error(t, authHook.Init("config"))
+
+	// every secret must be readable and hold a valid credential
+	secrets := &testSecrets{}
+	secrets.set("admin", "admin:password")
+	require.Error(t, authHook.Init(SecretManagerHookConfig{Names: []string{"admin"}, Provider: secrets}))
+	require.Error(t, authHook.Init(SecretManagerHookConfig{Names: []string{"missing"}, Provider: secrets}))
+}
+
+func TestSecretManagerAuthHookACL(t *testing.T) {
+	hash := testPasswordHashes(t, "secret")["mosquitto"]
+
+	secrets := &testSecrets{}
+	secrets.set("users", `{
+		"users": [{"username": "device", "password": "`+hash+`", "roles": ["device"]}],
+		"roles": {"device": {"publish": {"allow": ["devices/%c/#"]}, "subscribe": {"allow": ["commands/%u"]}}}
+	}`)
+	authHook := newTestSecretManagerAuthHook(t, secrets, "users")
+
+	cl := &mqtt.Client{ID: "d1"}
+	require.False(t, authHook.OnACLCheck(cl, "devices/d1/telemetry", true))
+	require.True(t, authHook.OnConnectAuthenticate(cl, adminConnect("device", "secret")))
+
+	require.True(t, authHook.OnACLCheck(cl, "devices/d1/telemetry", true))
+	require.False(t, authHook.OnACLCheck(cl, "devices/d2/telemetry", true))
+	require.True(t, authHook.OnACLCheck(cl, "commands/device", false))
+	require.False(t, authHook.OnACLCheck(cl, "commands/device", true))
+
+	// changed rules apply to connected clients after a refresh
+	secrets.set("users", `{
+		"users": [{"username": "device", "password": "`+hash+`", "roles": ["device"]}],
+		"roles": {"device": {"publish": {"allow": ["devices/%c/telemetry"]}}}
+	}`)
+	require.NoError(t, authHook.refresh(context.Background()))
+	require.True(t, authHook.OnACLCheck(cl, "devices/d1/telemetry", true))
+	require.False(t, authHook.OnACLCheck(cl, "devices/d1/status", true))
+	require.False(t, authHook.OnACLCheck(cl, "commands/device", false))
+}
+
+// countingHash is a passwordHash that records how often it is verified against
+type countingHash struct {
+	verified *int
+}
+
+func (h countingHash) verify(password []byte) bool {
+	*h.verified++
+	return false
+}
+
+func TestSecretManagerAuthHookUnknownUsername(t *testing.T) {
+	var verified int
+	dummy := dummyPasswordHash
+	dummyPasswordHash = countingHash{verified: &verified}
+	t.Cleanup(func() { dummyPasswordHash = dummy })
+
+	secrets := &testSecrets{}
+	secrets.set("admin", "admin:"+testPasswordHashes(t, "secret")["bcrypt"])
+	authHook := newTestSecretManagerAuthHook(t, secrets, "admin")
+
+	// unknown usernames are verified against the dummy hash, in both modes
+	require.Equal(t, AuthDeny, authHook.DecideConnect(&mqtt.Client{}, adminConnect("other", "secret")))
+	require.Equal(t, 1, verified)
+
+	authHook.mode = SecretManagerModeSuperuserOnly
+	require.Equal(t, AuthAbstain, authHook.DecideConnect(&mqtt.Client{}, adminConnect("other", "secret")))
+	require.Equal(t, 2, verified)
+
+	require.Equal(t, AuthAllow, authHook.DecideConnect(&mqtt.Client{}, adminConnect("admin", "secret")))
+	require.Equal(t, 2, verified)
+}
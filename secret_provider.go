@@ -0,0 +1,106 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+// SecretProvider reads the value of a named secret
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) ([]byte, error)
+}
+
+// GCPSecretProvider reads secrets from GCP Secret Manager. Names are secret versions such as
+// projects/my-project/secrets/my-secret/versions/1, a name without a version reads the latest version
+type GCPSecretProvider struct {
+	client *secretmanager.Client
+}
+
+// NewGCPSecretProvider creates a Secret Manager client using the default credentials
+func NewGCPSecretProvider(ctx context.Context) (*GCPSecretProvider, error) {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secretmanager client: %v", err)
+	}
+
+	return &GCPSecretProvider{client: client}, nil
+}
+
+func (p *GCPSecretProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	resp, err := p.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: secretVersionName(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Payload.Data, nil
+}
+
+// Close closes the Secret Manager client
+func (p *GCPSecretProvider) Close() error {
+	return p.client.Close()
+}
+
+// secretVersionName returns the name of a secret version, reading the latest version of a secret named
+// without one
+func secretVersionName(name string) string {
+	if strings.Contains(name, "/versions/") {
+		return name
+	}
+	return name + "/versions/latest"
+}
+
+// FileSecretProvider reads each secret from a file. Names are paths, relative to Dir if it is set
+type FileSecretProvider struct {
+	Dir string
+}
+
+func (p FileSecretProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	path := name
+	if p.Dir != "" && !filepath.IsAbs(name) {
+		path = filepath.Join(p.Dir, name)
+	}
+
+	return os.ReadFile(path)
+}
+
+// EnvSecretProvider reads each secret from the environment variable of the same name
+type EnvSecretProvider struct{}
+
+func (p EnvSecretProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return []byte(value), nil
+}
+
+// KubernetesSecretProvider reads secrets from a Kubernetes secret mounted as a directory. Names are the
+// keys of the secret. Each read goes through the directory's symlinks, so updates made by the kubelet are
+// seen on the next refresh
+type KubernetesSecretProvider struct {
+	Dir string // where the secret is mounted, e.g. /etc/mqtt-admins
+}
+
+func (p KubernetesSecretProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	if p.Dir == "" {
+		return nil, errors.New("secret directory is not set")
+	}
+
+	// keys are plain file names, anything else could read outside of the mounted secret or the kubelet's
+	// ..data links
+	if name == "" || name == "." || name != filepath.Base(name) || strings.HasPrefix(name, "..") {
+		return nil, fmt.Errorf("invalid secret key %q", name)
+	}
+
+	return os.ReadFile(filepath.Join(p.Dir, name))
+}
@@ -0,0 +1,66 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSecretProvider(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "admin"), []byte("admin:hash\n"), 0o600))
+
+	secret, err := FileSecretProvider{Dir: dir}.GetSecret(context.Background(), "admin")
+	require.NoError(t, err)
+	require.Equal(t, "admin:hash\n", string(secret))
+
+	// absolute paths are read as is
+	secret, err = FileSecretProvider{Dir: "/unused"}.GetSecret(context.Background(), filepath.Join(dir, "admin"))
+	require.NoError(t, err)
+	require.Equal(t, "admin:hash\n", string(secret))
+
+	_, err = FileSecretProvider{Dir: dir}.GetSecret(context.Background(), "missing")
+	require.Error(t, err)
+}
+
+func TestEnvSecretProvider(t *testing.T) {
+	t.Setenv("MQTT_ADMIN", "admin:hash")
+
+	secret, err := EnvSecretProvider{}.GetSecret(context.Background(), "MQTT_ADMIN")
+	require.NoError(t, err)
+	require.Equal(t, "admin:hash", string(secret))
+
+	_, err = EnvSecretProvider{}.GetSecret(context.Background(), "MQTT_ADMIN_MISSING")
+	require.Error(t, err)
+}
+
+func TestKubernetesSecretProvider(t *testing.T) {
+	// mounted secrets are symlinks into a ..data directory that the kubelet swaps on update
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..2023_01_01"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..2023_01_01", "admin"), []byte("admin:hash"), 0o600))
+	require.NoError(t, os.Symlink("..2023_01_01", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "admin"), filepath.Join(dir, "admin")))
+
+	provider := KubernetesSecretProvider{Dir: dir}
+
+	secret, err := provider.GetSecret(context.Background(), "admin")
+	require.NoError(t, err)
+	require.Equal(t, "admin:hash", string(secret))
+
+	for _, name := range []string{"", ".", "..", "..data", "../admin", "sub/admin", "missing"} {
+		_, err := provider.GetSecret(context.Background(), name)
+		require.Error(t, err, name)
+	}
+
+	_, err = KubernetesSecretProvider{}.GetSecret(context.Background(), "admin")
+	require.Error(t, err)
+}
+
+func TestSecretVersionName(t *testing.T) {
+	require.Equal(t, "projects/p/secrets/s/versions/latest", secretVersionName("projects/p/secrets/s"))
+	require.Equal(t, "projects/p/secrets/s/versions/3", secretVersionName("projects/p/secrets/s/versions/3"))
+}
@@ -0,0 +1,198 @@
+package mochicloudhooks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures TLS to the auth endpoints. The CA bundle and client certificate are reloaded
+// whenever the files change on disk, so rotated certificates are picked up without a restart
+type TLSConfig struct {
+	CAFile     string // PEM bundle of CAs trusted for the auth endpoints, defaults to the system pool
+	CertFile   string // PEM client certificate presented to the auth endpoints
+	KeyFile    string // PEM key of the client certificate
+	ServerName string // overrides the server name used for SNI and verification
+	MinVersion uint16 // defaults to TLS 1.2
+}
+
+// Enabled reports whether any TLS settings have been configured
+func (tc TLSConfig) Enabled() bool {
+	return tc != TLSConfig{}
+}
+
+// tlsReloader holds the current CA pool and client certificate, reloading them when their files change.
+// Each new connection is dialed with the latest files so rotated certificates apply to new connections
+type tlsReloader struct {
+	config      TLSConfig
+	mu          sync.Mutex
+	caModTime   time.Time
+	certModTime time.Time
+	keyModTime  time.Time
+	pool        *x509.CertPool
+	cert        *tls.Certificate
+}
+
+func newTLSReloader(config TLSConfig) (*tlsReloader, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("tls cert file and key file must be set together")
+	}
+
+	r := &tlsReloader{config: config}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newTLSTransport returns a copy of base using the TLS configuration. base must be nil or an *http.Transport
+func newTLSTransport(base http.RoundTripper, config TLSConfig) (*http.Transport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("tls config requires the round tripper to be nil or an *http.Transport")
+	}
+
+	r, err := newTLSReloader(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport = transport.Clone()
+	transport.DialTLSContext = r.dialTLSContext
+
+	return transport, nil
+}
+
+// dialTLSContext dials with a tls.Config built from the latest CA pool and client certificate
+func (r *tlsReloader) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := r.tlsConfig()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	dialer := &tls.Dialer{Config: config}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	r.reloadQuietly()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	minVersion := r.config.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: r.config.ServerName,
+		RootCAs:    r.pool,
+	}
+
+	if r.cert != nil {
+		config.Certificates = []tls.Certificate{*r.cert}
+	}
+
+	return config
+}
+
+// reloadQuietly reloads changed files, keeping the last good certificates if a file cannot be loaded,
+// e.g. while a certificate and its key are being rotated
+func (r *tlsReloader) reloadQuietly() {
+	_ = r.reload()
+}
+
+func (r *tlsReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the files are reloaded independently so a bad CA bundle does not hold back a rotated certificate
+	caErr := r.reloadCA()
+	certErr := r.reloadCert()
+	if caErr != nil {
+		return caErr
+	}
+	return certErr
+}
+
+// reloadCA must be called with the lock held
+func (r *tlsReloader) reloadCA() error {
+	if r.config.CAFile == "" {
+		return nil
+	}
+
+	modTime, err := fileModTime(r.config.CAFile)
+	if err != nil || modTime.Equal(r.caModTime) {
+		return err
+	}
+
+	pem, err := os.ReadFile(r.config.CAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", r.config.CAFile)
+	}
+
+	r.pool = pool
+	r.caModTime = modTime
+	return nil
+}
+
+// reloadCert must be called with the lock held
+func (r *tlsReloader) reloadCert() error {
+	if r.config.CertFile == "" {
+		return nil
+	}
+
+	certModTime, err := fileModTime(r.config.CertFile)
+	if err != nil {
+		return err
+	}
+	keyModTime, err := fileModTime(r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,288 @@
+package mochicloudhooks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca testCA) issue(t *testing.T, name string, client bool) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes the file and bumps its modification time so reloads notice the change
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func newMTLSServer(t *testing.T, serverCA, clientCA testCA) *httptest.Server {
+	certPEM, keyPEM := serverCA.issue(t, "auth-server", false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestTLSTransport(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	clientCert, clientKey := clientCA.issue(t, "broker", true)
+	untrustedCert, untrustedKey := otherCA.issue(t, "broker", true)
+
+	tests := []struct {
+		name      string
+		caPEM     []byte
+		certPEM   []byte
+		keyPEM    []byte
+		expectErr bool
+	}{
+		{
+			name:    "Success - Trusted CA and client certificate",
+			caPEM:   serverCA.pem,
+			certPEM: clientCert,
+			keyPEM:  clientKey,
+		},
+		{
+			name:      "Error - Server not signed by CA",
+			caPEM:     otherCA.pem,
+			certPEM:   clientCert,
+			keyPEM:    clientKey,
+			expectErr: true,
+		},
+		{
+			name:      "Error - Client certificate not trusted by server",
+			caPEM:     serverCA.pem,
+			certPEM:   untrustedCert,
+			keyPEM:    untrustedKey,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := TLSConfig{
+				CAFile:   filepath.Join(dir, "ca.pem"),
+				CertFile: filepath.Join(dir, "cert.pem"),
+				KeyFile:  filepath.Join(dir, "key.pem"),
+			}
+			writeFile(t, config.CAFile, tt.caPEM, time.Now())
+			writeFile(t, config.CertFile, tt.certPEM, time.Now())
+			writeFile(t, config.KeyFile, tt.keyPEM, time.Now())
+
+			transport, err := newTLSTransport(nil, config)
+			require.NoError(t, err)
+
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestTLSTransportReload(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	clientCert, clientKey := clientCA.issue(t, "broker", true)
+	untrustedCert, untrustedKey := otherCA.issue(t, "broker", true)
+
+	dir := t.TempDir()
+	config := TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	start := time.Now().Add(-time.Minute)
+	writeFile(t, config.CAFile, otherCA.pem, start)
+	writeFile(t, config.CertFile, clientCert, start)
+	writeFile(t, config.KeyFile, clientKey, start)
+
+	transport, err := newTLSTransport(nil, config)
+	require.NoError(t, err)
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport}
+
+	_, err = client.Get(server.URL)
+	require.Error(t, err)
+
+	// the rotated CA bundle is picked up by the next connection
+	writeFile(t, config.CAFile, serverCA.pem, start.Add(time.Second))
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// as is a rotated client certificate
+	writeFile(t, config.CertFile, untrustedCert, start.Add(time.Second))
+	writeFile(t, config.KeyFile, untrustedKey, start.Add(time.Second))
+	_, err = client.Get(server.URL)
+	require.Error(t, err)
+
+	// a broken rotation keeps the last good certificate
+	writeFile(t, config.CertFile, clientCert, start.Add(2*time.Second))
+	writeFile(t, config.KeyFile, []byte("not a key"), start.Add(2*time.Second))
+	_, err = client.Get(server.URL)
+	require.Error(t, err)
+}
+
+func TestNewTLSTransportErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		name   string
+		base   http.RoundTripper
+		config TLSConfig
+	}{
+		{
+			name:   "Error - Unsupported round tripper",
+			base:   NewMockRoundTripper(ctrl),
+			config: TLSConfig{ServerName: "auth"},
+		},
+		{
+			name:   "Error - Cert without key",
+			config: TLSConfig{CertFile: filepath.Join(dir, "cert.pem")},
+		},
+		{
+			name:   "Error - Missing CA file",
+			config: TLSConfig{CAFile: filepath.Join(dir, "missing.pem")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSTransport(tt.base, tt.config)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestHTTPAuthHookTLS(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	server := newMTLSServer(t, serverCA, clientCA)
+
+	clientCert, clientKey := clientCA.issue(t, "broker", true)
+
+	dir := t.TempDir()
+	config := TLSConfig{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		MinVersion: tls.VersionTLS13,
+	}
+	writeFile(t, config.CAFile, serverCA.pem, time.Now())
+	writeFile(t, config.CertFile, clientCert, time.Now())
+	writeFile(t, config.KeyFile, clientKey, time.Now())
+
+	authHook := new(HTTPAuthHook)
+	authHook.Log = &zerolog.Logger{}
+	require.NoError(t, authHook.Init(HTTPAuthHookConfig{
+		ACLHost:                  server.URL,
+		ClientAuthenticationHost: server.URL,
+		TLS:                      config,
+	}))
+
+	require.True(t, authHook.OnACLCheck(&mqtt.Client{ID: defaultClientID}, "/topic", false))
+}
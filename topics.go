@@ -0,0 +1,60 @@
+package mochicloudhooks
+
+import "strings"
+
+// matchTopicFilter reports whether filter matches topic. The topic may itself be a subscription
+// filter, in which case it only matches if every topic it could match is also matched by filter
+func matchTopicFilter(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// wildcards at the first level never match topics beginning with $ [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		switch {
+		case level == "+":
+			if topicLevels[i] == "#" {
+				return false
+			}
+		case level != topicLevels[i]:
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// topicFiltersOverlap reports whether some topic is matched by both filters
+func topicFiltersOverlap(a, b string) bool {
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	// wildcards at the first level never match topics beginning with $ [MQTT-4.7.2-1]
+	if strings.HasPrefix(a, "$") != strings.HasPrefix(b, "$") {
+		return false
+	}
+
+	for i := 0; ; i++ {
+		switch {
+		case i < len(aLevels) && aLevels[i] == "#", i < len(bLevels) && bLevels[i] == "#":
+			return true
+		case i >= len(aLevels) || i >= len(bLevels):
+			return len(aLevels) == len(bLevels)
+		case aLevels[i] == "+" || bLevels[i] == "+":
+			continue
+		case aLevels[i] != bLevels[i]:
+			return false
+		}
+	}
+}
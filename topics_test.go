@@ -0,0 +1,62 @@
+package mochicloudhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopicFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		filter      string
+		topic       string
+		expectMatch bool
+	}{
+		{name: "Success - Exact match", filter: "a/b/c", topic: "a/b/c", expectMatch: true},
+		{name: "Success - Single level wildcard", filter: "a/+/c", topic: "a/b/c", expectMatch: true},
+		{name: "Success - Multi level wildcard", filter: "a/#", topic: "a/b/c", expectMatch: true},
+		{name: "Success - Multi level wildcard matches parent", filter: "a/#", topic: "a", expectMatch: true},
+		{name: "Success - Filter covers narrower filter", filter: "a/#", topic: "a/+/c", expectMatch: true},
+		{name: "Success - Single level wildcard covers single level wildcard", filter: "a/+", topic: "a/+", expectMatch: true},
+		{name: "Failure - Different level", filter: "a/b/c", topic: "a/b/d", expectMatch: false},
+		{name: "Failure - Topic longer than filter", filter: "a/+", topic: "a/b/c", expectMatch: false},
+		{name: "Failure - Topic shorter than filter", filter: "a/b/c", topic: "a/b", expectMatch: false},
+		{name: "Failure - Single level wildcard does not cover multi level wildcard", filter: "a/+", topic: "a/#", expectMatch: false},
+		{name: "Failure - Literal does not cover wildcard", filter: "a/b", topic: "a/+", expectMatch: false},
+		{name: "Failure - Wildcard does not match $ topics", filter: "#", topic: "$SYS/info", expectMatch: false},
+		{name: "Success - Literal $ topics match", filter: "$SYS/#", topic: "$SYS/info", expectMatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectMatch, matchTopicFilter(tt.filter, tt.topic))
+		})
+	}
+}
+
+func TestTopicFiltersOverlap(t *testing.T) {
+	tests := []struct {
+		name          string
+		a             string
+		b             string
+		expectOverlap bool
+	}{
+		{name: "Success - Same topic", a: "a/b", b: "a/b", expectOverlap: true},
+		{name: "Success - Single level wildcards", a: "a/+/c", b: "a/b/+", expectOverlap: true},
+		{name: "Success - Multi level wildcard", a: "a/b/c", b: "a/#", expectOverlap: true},
+		{name: "Success - Multi level wildcard matches parent", a: "a", b: "a/#", expectOverlap: true},
+		{name: "Success - Broader filter", a: "a/secret", b: "#", expectOverlap: true},
+		{name: "Failure - Different level", a: "a/+/c", b: "a/b/d", expectOverlap: false},
+		{name: "Failure - Different length", a: "a/+", b: "a/b/c", expectOverlap: false},
+		{name: "Failure - Wildcard does not match $ topics", a: "#", b: "$SYS/info", expectOverlap: false},
+		{name: "Success - Literal $ topics", a: "$SYS/+", b: "$SYS/info", expectOverlap: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectOverlap, topicFiltersOverlap(tt.a, tt.b))
+			require.Equal(t, tt.expectOverlap, topicFiltersOverlap(tt.b, tt.a))
+		})
+	}
+}
@@ -1,10 +1,47 @@
 package mochicloudhooks
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
 // Transport represents everything required for adding to the roundtripper interface
 type Transport struct {
 	OriginalTransport http.RoundTripper
+	Retry             RetryConfig
+}
+
+// RetryConfig configures how failed requests are retried. A MaxAttempts of zero or one disables retries
+type RetryConfig struct {
+	MaxAttempts          int
+	BaseBackoff          time.Duration
+	MaxBackoff           time.Duration
+	Jitter               float64 // fraction of each backoff that is randomized, between 0 and 1
+	RetryableStatusCodes []int   // defaults to 502, 503 and 504
+	RespectRetryAfter    bool
+}
+
+var errNoGetBody = errors.New("request body cannot be rewound")
+
+var defaultRetryableStatusCodes = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
 }
 
 // NewTransport creates a new Transport object with any passed in information
@@ -20,7 +57,451 @@ func NewTransport(rt http.RoundTripper) *http.Client {
 	}
 }
 
-// RoundTrip goes through the HTTP RoundTrip implementation and attempts to add ASAP if not passed it
+// RoundTrip goes through the HTTP RoundTrip implementation, retrying failed attempts as configured
 func (st *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	return st.OriginalTransport.RoundTrip(r)
+	rt := orDefaultTransport(st.OriginalTransport)
+
+	maxAttempts := st.Retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	req := r
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.RoundTrip(req)
+		if attempt >= maxAttempts || !st.Retry.shouldRetry(resp, err) || r.Context().Err() != nil {
+			return resp, err
+		}
+
+		// the request can only be replayed if its body can be read again
+		next, rerr := rewindRequest(r)
+		if rerr != nil {
+			return resp, err
+		}
+
+		wait := st.Retry.backoff(attempt, resp)
+		if resp != nil && resp.Body != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+
+		req = next
+	}
+}
+
+func (rc RetryConfig) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	codes := rc.RetryableStatusCodes
+	if len(codes) == 0 {
+		codes = defaultRetryableStatusCodes
+	}
+
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns how long to wait after the given attempt, preferring the server's Retry-After if allowed
+func (rc RetryConfig) backoff(attempt int, resp *http.Response) time.Duration {
+	if rc.RespectRetryAfter && resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if rc.MaxBackoff > 0 && d > rc.MaxBackoff {
+				d = rc.MaxBackoff
+			}
+			return d
+		}
+	}
+
+	d := time.Duration(float64(rc.BaseBackoff) * math.Pow(2, float64(attempt-1)))
+	if d <= 0 || (rc.MaxBackoff > 0 && d > rc.MaxBackoff) {
+		d = rc.MaxBackoff
+	}
+
+	if rc.Jitter > 0 && d > 0 {
+		jitter := rc.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+
+	return d
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		d := time.Until(date)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// rewindRequest returns a copy of r with a fresh body so it can be sent again
+func rewindRequest(r *http.Request) (*http.Request, error) {
+	req := r.Clone(r.Context())
+	if r.Body == nil || r.Body == http.NoBody {
+		return req, nil
+	}
+
+	if r.GetBody == nil {
+		return nil, errNoGetBody
+	}
+
+	body, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+
+	return req, nil
+}
+
+func orDefaultTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		return http.DefaultTransport
+	}
+	return rt
+}
+
+// TokenSource provides bearer tokens for outbound requests
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource is a TokenSource that always returns the same token
+type StaticTokenSource string
+
+// Token returns the static token
+func (s StaticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+// AuthTransport is layered on a Transport to add static headers and a bearer token to each request
+type AuthTransport struct {
+	OriginalTransport http.RoundTripper
+	Headers           map[string]string
+	TokenSource       TokenSource
+}
+
+// RoundTrip adds the configured credentials to the request. If the token is rejected and the token source
+// can invalidate it, the request is replayed once with a fresh token. A token only counts as rejected when
+// a 401 carries a WWW-Authenticate header with error="invalid_token", as other 401s are how the auth
+// endpoints deny clients
+func (at *AuthTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt := orDefaultTransport(at.OriginalTransport)
+
+	req, err := at.authorize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil || !tokenRejected(resp) {
+		return resp, err
+	}
+
+	invalidator, ok := at.TokenSource.(interface{ Invalidate() })
+	if !ok {
+		return resp, nil
+	}
+	invalidator.Invalidate()
+
+	replay, rerr := rewindRequest(r)
+	if rerr != nil {
+		return resp, nil
+	}
+	if req, err = at.authorize(replay); err != nil {
+		return resp, nil
+	}
+
+	if resp.Body != nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	return rt.RoundTrip(req)
+}
+
+// tokenRejected reports whether a response rejects the bearer token of the request, as described by RFC 6750
+func tokenRejected(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params, _ := strings.Cut(challenge, " ")
+		if strings.EqualFold(scheme, "Bearer") && strings.Contains(params, `error="invalid_token"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns a copy of r carrying the configured headers and token
+func (at *AuthTransport) authorize(r *http.Request) (*http.Request, error) {
+	req := r.Clone(r.Context())
+	req.Body = r.Body
+
+	for k, v := range at.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if at.TokenSource != nil {
+		token, err := at.TokenSource.Token(r.Context())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
+
+// ClientCredentialsTokenSource is a TokenSource fetching tokens with the OAuth2 client credentials grant.
+// Tokens are cached until shortly before they expire
+type ClientCredentialsTokenSource struct {
+	TokenURL       string
+	ClientID       string
+	ClientSecret   string
+	Scopes         []string
+	EndpointParams url.Values    // extra parameters sent to the token endpoint, e.g. audience
+	ExpiryDelta    time.Duration // how long before expiry a token is refreshed, defaults to 10 seconds
+	HTTPClient     *http.Client  // defaults to http.DefaultClient
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token returns the cached token, fetching a new one if it is missing or about to expire
+func (cc *ClientCredentialsTokenSource) Token(ctx context.Context) (string, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	delta := cc.ExpiryDelta
+	if delta <= 0 {
+		delta = 10 * time.Second
+	}
+
+	if cc.token != "" && (cc.expiry.IsZero() || time.Now().Add(delta).Before(cc.expiry)) {
+		return cc.token, nil
+	}
+
+	token, expiry, err := cc.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	cc.token = token
+	cc.expiry = expiry
+
+	return token, nil
+}
+
+// Invalidate drops the cached token so the next call to Token fetches a new one
+func (cc *ClientCredentialsTokenSource) Invalidate() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.token = ""
+	cc.expiry = time.Time{}
+}
+
+func (cc *ClientCredentialsTokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{}
+	for k, v := range cc.EndpointParams {
+		form[k] = v
+	}
+	form.Set("grant_type", "client_credentials")
+	if len(cc.Scopes) > 0 {
+		form.Set("scope", strings.Join(cc.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cc.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(cc.ClientID), url.QueryEscape(cc.ClientSecret))
+
+	client := cc.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBodySize)).Decode(&tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	if tr.AccessToken == "" {
+		return "", time.Time{}, errors.New("token response is missing access_token")
+	}
+
+	var expiry time.Time
+	if tr.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	return tr.AccessToken, expiry, nil
+}
+
+const (
+	// SignatureTimestampHeader carries the unix time the request was signed at
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	// SignatureKeyIDHeader carries the id of the key the request was signed with
+	SignatureKeyIDHeader = "X-Signature-Key-Id"
+	// SignatureHeader carries the hex encoded HMAC-SHA256 signature of the request
+	SignatureHeader = "X-Signature"
+)
+
+// SigningConfig configures HMAC request signing. Keys maps key ids to secrets so keys can be rotated
+// by adding the new key, switching ActiveKeyID, then removing the old key once the receiver has caught up
+type SigningConfig struct {
+	Keys        map[string][]byte
+	ActiveKeyID string
+}
+
+// Enabled reports whether signing has been configured
+func (sc SigningConfig) Enabled() bool {
+	return sc.ActiveKeyID != ""
+}
+
+func (sc SigningConfig) validate() error {
+	if !sc.Enabled() {
+		return nil
+	}
+	if len(sc.Keys[sc.ActiveKeyID]) == 0 {
+		return fmt.Errorf("signing key %q not found", sc.ActiveKeyID)
+	}
+	return nil
+}
+
+// SigningTransport is layered on a Transport to sign each request with the active HMAC key
+type SigningTransport struct {
+	OriginalTransport http.RoundTripper
+	Signing           SigningConfig
+}
+
+// RoundTrip adds a timestamp and an HMAC-SHA256 signature over the method, request URI, timestamp and body
+func (st *SigningTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key, ok := st.Signing.Keys[st.Signing.ActiveKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not found", st.Signing.ActiveKeyID)
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(SignatureTimestampHeader, timestamp)
+	req.Header.Set(SignatureKeyIDHeader, st.Signing.ActiveKeyID)
+	req.Header.Set(SignatureHeader, signRequest(key, req.Method, req.URL.RequestURI(), timestamp, body))
+
+	return orDefaultTransport(st.OriginalTransport).RoundTrip(req)
+}
+
+// VerifySignature checks a request signed by SigningTransport against keys, rejecting timestamps
+// further than maxSkew from now. It is intended for auth services written in Go and restores the body
+func VerifySignature(r *http.Request, keys map[string][]byte, maxSkew time.Duration) error {
+	key, ok := keys[r.Header.Get(SignatureKeyIDHeader)]
+	if !ok {
+		return errors.New("unknown signing key")
+	}
+
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if maxSkew > 0 && skew > maxSkew {
+		return errors.New("signature timestamp outside allowed skew")
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(key, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+func signRequest(key []byte, method, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	defer r.Body.Close()
+
+	return io.ReadAll(r.Body)
 }
@@ -1,8 +1,16 @@
 package mochicloudhooks
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -39,3 +47,424 @@ func TestRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestRoundTripRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	respond := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(nil))}
+	}
+
+	tests := []struct {
+		name         string
+		retry        RetryConfig
+		mocks        func()
+		expectStatus int
+		expectErr    bool
+	}{
+		{
+			name:  "Success - No retry configured",
+			retry: RetryConfig{},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusServiceUnavailable), nil).Times(1)
+			},
+			expectStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:  "Success - Retries retryable status until success",
+			retry: RetryConfig{MaxAttempts: 3, BaseBackoff: time.Millisecond, Jitter: 0.5},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusBadGateway), nil).Times(1)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusGatewayTimeout), nil).Times(1)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK), nil).Times(1)
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:  "Success - Retries transport errors",
+			retry: RetryConfig{MaxAttempts: 2, BaseBackoff: time.Millisecond},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap")).Times(1)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK), nil).Times(1)
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:  "Success - Non retryable status returned immediately",
+			retry: RetryConfig{MaxAttempts: 3, BaseBackoff: time.Millisecond},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusForbidden), nil).Times(1)
+			},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:  "Success - Custom retryable status codes",
+			retry: RetryConfig{MaxAttempts: 2, RetryableStatusCodes: []int{http.StatusTooManyRequests}},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusTooManyRequests), nil).Times(1)
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(respond(http.StatusOK), nil).Times(1)
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:  "Error - Attempts exhausted",
+			retry: RetryConfig{MaxAttempts: 2, BaseBackoff: time.Millisecond},
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap")).Times(2)
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mocks()
+
+			req, _ := http.NewRequest(http.MethodPost, "http://example.com", bytes.NewBufferString("body"))
+			nt := &Transport{
+				OriginalTransport: mockRT,
+				Retry:             tt.retry,
+			}
+
+			resp, err := nt.RoundTrip(req)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestRoundTripRetryReplaysBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	var bodies []string
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			return nil, errors.New("Oh Crap")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}).Times(2)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", bytes.NewBufferString("body"))
+	nt := &Transport{
+		OriginalTransport: mockRT,
+		Retry:             RetryConfig{MaxAttempts: 2},
+	}
+
+	_, err := nt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"body", "body"}, bodies)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		retry  RetryConfig
+		resp   *http.Response
+		expect time.Duration
+	}{
+		{
+			name:   "Success - Exponential backoff",
+			retry:  RetryConfig{BaseBackoff: 100 * time.Millisecond},
+			expect: 400 * time.Millisecond,
+		},
+		{
+			name:   "Success - Capped by max backoff",
+			retry:  RetryConfig{BaseBackoff: 100 * time.Millisecond, MaxBackoff: 250 * time.Millisecond},
+			expect: 250 * time.Millisecond,
+		},
+		{
+			name:   "Success - Retry-After seconds honored",
+			retry:  RetryConfig{BaseBackoff: 100 * time.Millisecond, RespectRetryAfter: true},
+			resp:   &http.Response{Header: http.Header{"Retry-After": []string{"2"}}},
+			expect: 2 * time.Second,
+		},
+		{
+			name:   "Success - Retry-After capped by max backoff",
+			retry:  RetryConfig{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, RespectRetryAfter: true},
+			resp:   &http.Response{Header: http.Header{"Retry-After": []string{"120"}}},
+			expect: time.Second,
+		},
+		{
+			name:   "Success - Retry-After ignored when not respected",
+			retry:  RetryConfig{BaseBackoff: 100 * time.Millisecond},
+			resp:   &http.Response{Header: http.Header{"Retry-After": []string{"2"}}},
+			expect: 400 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expect, tt.retry.backoff(3, tt.resp))
+		})
+	}
+}
+
+func newTokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var issued int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		require.Equal(t, "auth:read auth:write", r.PostForm.Get("scope"))
+
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &issued
+}
+
+func TestClientCredentialsTokenSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		expiresIn    int
+		clientSecret string
+		expectTokens []string
+		expectIssued int32
+		expectErr    bool
+	}{
+		{
+			name:         "Success - Token cached until expiry",
+			expiresIn:    3600,
+			clientSecret: "secret",
+			expectTokens: []string{"token-1", "token-1", "token-1"},
+			expectIssued: 1,
+		},
+		{
+			name:         "Success - Token refreshed when about to expire",
+			expiresIn:    5,
+			clientSecret: "secret",
+			expectTokens: []string{"token-1", "token-2", "token-3"},
+			expectIssued: 3,
+		},
+		{
+			name:         "Error - Token endpoint rejects credentials",
+			expiresIn:    3600,
+			clientSecret: "wrong",
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, issued := newTokenServer(t, tt.expiresIn)
+
+			ts := &ClientCredentialsTokenSource{
+				TokenURL:     server.URL,
+				ClientID:     "client",
+				ClientSecret: tt.clientSecret,
+				Scopes:       []string{"auth:read", "auth:write"},
+			}
+
+			if tt.expectErr {
+				_, err := ts.Token(context.Background())
+				require.Error(t, err)
+				return
+			}
+
+			for _, expect := range tt.expectTokens {
+				token, err := ts.Token(context.Background())
+				require.NoError(t, err)
+				require.Equal(t, expect, token)
+			}
+			require.Equal(t, tt.expectIssued, atomic.LoadInt32(issued))
+		})
+	}
+}
+
+func TestAuthTransport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	at := &AuthTransport{
+		OriginalTransport: mockRT,
+		Headers:           map[string]string{"X-Api-Key": "key"},
+		TokenSource:       StaticTokenSource("static"),
+	}
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(r *http.Request) (*http.Response, error) {
+		require.Equal(t, "key", r.Header.Get("X-Api-Key"))
+		require.Equal(t, "Bearer static", r.Header.Get("Authorization"))
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", bytes.NewBufferString("body"))
+	resp, err := at.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the original request is left untouched
+	require.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestAuthTransportRefreshesRejectedToken(t *testing.T) {
+	server, issued := newTokenServer(t, 3600)
+
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.Equal(t, "body", string(body))
+
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="auth", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	client := NewTransport(&Transport{
+		OriginalTransport: &AuthTransport{
+			TokenSource: &ClientCredentialsTokenSource{
+				TokenURL:     server.URL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				Scopes:       []string{"auth:read", "auth:write"},
+			},
+		},
+	})
+
+	resp, err := client.Post(api.URL, "text/plain", bytes.NewBufferString("body"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, seen)
+	require.Equal(t, int32(2), atomic.LoadInt32(issued))
+}
+
+func TestAuthTransportKeepsTokenOnDenial(t *testing.T) {
+	server, issued := newTokenServer(t, 3600)
+
+	var requests int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// a 401 without a token error is the endpoint denying the MQTT client
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer api.Close()
+
+	client := NewTransport(&Transport{
+		OriginalTransport: &AuthTransport{
+			TokenSource: &ClientCredentialsTokenSource{
+				TokenURL:     server.URL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				Scopes:       []string{"auth:read", "auth:write"},
+			},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post(api.URL, "text/plain", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	require.Equal(t, 3, requests)
+	require.Equal(t, int32(1), atomic.LoadInt32(issued))
+}
+
+func TestSigningTransport(t *testing.T) {
+	keys := map[string][]byte{
+		"old": []byte("old-secret"),
+		"new": []byte("new-secret"),
+	}
+
+	tests := []struct {
+		name      string
+		signing   SigningConfig
+		verifyKey map[string][]byte
+		tamper    func(r *http.Request)
+		expectErr bool
+	}{
+		{
+			name:      "Success - Signed with active key",
+			signing:   SigningConfig{Keys: keys, ActiveKeyID: "new"},
+			verifyKey: keys,
+		},
+		{
+			name:      "Success - Old key still verifies during rotation",
+			signing:   SigningConfig{Keys: keys, ActiveKeyID: "old"},
+			verifyKey: keys,
+		},
+		{
+			name:      "Error - Retired key",
+			signing:   SigningConfig{Keys: keys, ActiveKeyID: "old"},
+			verifyKey: map[string][]byte{"new": keys["new"]},
+			expectErr: true,
+		},
+		{
+			name:      "Error - Tampered path",
+			signing:   SigningConfig{Keys: keys, ActiveKeyID: "new"},
+			verifyKey: keys,
+			tamper: func(r *http.Request) {
+				r.URL.Path = "/other"
+			},
+			expectErr: true,
+		},
+		{
+			name:      "Error - Stale timestamp",
+			signing:   SigningConfig{Keys: keys, ActiveKeyID: "new"},
+			verifyKey: keys,
+			tamper: func(r *http.Request) {
+				r.Header.Set(SignatureTimestampHeader, "1")
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var verifyErr error
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.tamper != nil {
+					tt.tamper(r)
+				}
+				verifyErr = VerifySignature(r, tt.verifyKey, time.Minute)
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			client := NewTransport(&SigningTransport{Signing: tt.signing})
+			resp, err := client.Post(server.URL+"/acl?topic=a", "application/json", bytes.NewBufferString(`{"topic":"a"}`))
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			if tt.expectErr {
+				require.Error(t, verifyErr)
+				return
+			}
+			require.NoError(t, verifyErr)
+			require.Equal(t, `{"topic":"a"}`, string(body))
+		})
+	}
+}
+
+func TestSigningConfigValidate(t *testing.T) {
+	require.NoError(t, SigningConfig{}.validate())
+	require.NoError(t, SigningConfig{Keys: map[string][]byte{"a": []byte("s")}, ActiveKeyID: "a"}.validate())
+	require.Error(t, SigningConfig{Keys: map[string][]byte{"a": []byte("s")}, ActiveKeyID: "b"}.validate())
+}